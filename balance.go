@@ -0,0 +1,154 @@
+package gw
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// defaultNatsPort is used for the discovered addresses that have no port
+const defaultNatsPort = "4222"
+
+// BalanceStrategy is used in Settings for choosing the order in which the
+// nats server addresses are tried
+type BalanceStrategy int
+
+const (
+	// Ordered tries the addresses in the order they are configured,
+	// NatsAddr first
+	Ordered BalanceStrategy = iota
+	// RoundRobin starts with a different address for each connection
+	RoundRobin
+	// Random tries the addresses in a random order
+	Random
+)
+
+// natsAddrs returns the nats server addresses, in the order they should be
+// tried
+func (gw *Gateway) natsAddrs() []string {
+	var addrs []string
+	if gw.settings.NatsAddr != "" {
+		addrs = append(addrs, gw.settings.NatsAddr)
+	}
+	addrs = append(addrs, gw.settings.NatsAddrs...)
+	for _, addr := range gw.getDiscoveredAddrs() {
+		if !containsString(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) < 2 {
+		return addrs
+	}
+
+	switch gw.settings.BalanceStrategy {
+	case RoundRobin:
+		start := int(gw.addrCounter.Add(1)-1) % len(addrs)
+		addrs = append(addrs[start:], addrs[:start]...)
+	case Random:
+		rand.Shuffle(len(addrs), func(i, j int) {
+			addrs[i], addrs[j] = addrs[j], addrs[i]
+		})
+	}
+	return addrs
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNatsAddr parses a NatsAddr or NatsAddrs entry, either a host:port or
+// a nats:// or tls:// URL, into a host:port address. A tls:// URL requires
+// TLS. The port defaults to 4222
+func parseNatsAddr(addr string) (string, bool, error) {
+	if !strings.Contains(addr, "://") {
+		return addr, false, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", false, err
+	}
+	var tls bool
+	switch u.Scheme {
+	case "nats":
+	case "tls":
+		tls = true
+	default:
+		return "", false, fmt.Errorf("unsupported scheme %q, expected nats:// or tls://", u.Scheme)
+	}
+	if u.User != nil {
+		return "", false, fmt.Errorf("credentials are not supported, see ConnectHandler")
+	}
+	if u.Hostname() == "" {
+		return "", false, fmt.Errorf("missing host")
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultNatsPort
+	}
+	return net.JoinHostPort(u.Hostname(), port), tls, nil
+}
+
+// withParsedAddrs returns the settings with the NatsAddr and NatsAddrs URLs
+// turned into host:port addresses, EnableTLS being set by a tls:// one
+func (s Settings) withParsedAddrs() (Settings, error) {
+	addr, tls, err := parseNatsAddr(s.NatsAddr)
+	if err != nil {
+		return s, fmt.Errorf("Invalid settings: NatsAddr %q: %w", s.NatsAddr, err)
+	}
+	s.NatsAddr = addr
+	s.EnableTLS = s.EnableTLS || tls
+	addrs := make([]string, 0, len(s.NatsAddrs))
+	for _, addr := range s.NatsAddrs {
+		parsed, tls, err := parseNatsAddr(addr)
+		if err != nil {
+			return s, fmt.Errorf("Invalid settings: NatsAddrs %q: %w", addr, err)
+		}
+		addrs = append(addrs, parsed)
+		s.EnableTLS = s.EnableTLS || tls
+	}
+	if s.NatsAddrs != nil {
+		s.NatsAddrs = addrs
+	}
+	return s, nil
+}
+
+// normalizeConnectURL turns a connect_urls entry into a host:port address
+func normalizeConnectURL(url string) string {
+	if i := strings.Index(url, "://"); i != -1 {
+		url = url[i+3:]
+	}
+	if _, _, err := net.SplitHostPort(url); err == nil {
+		return url
+	}
+	return net.JoinHostPort(strings.Trim(url, "[]"), defaultNatsPort)
+}
+
+// learnConnectURLs caches the cluster addresses advertised by a server INFO.
+// An empty list (single node server) leaves the cache untouched
+func (gw *Gateway) learnConnectURLs(urls []string) {
+	if gw.settings.IgnoreConnectURLs || gw.natsNetwork() != "tcp" || len(urls) == 0 {
+		return
+	}
+	addrs := make([]string, 0, len(urls))
+	for _, url := range urls {
+		if url != "" {
+			addrs = append(addrs, normalizeConnectURL(url))
+		}
+	}
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	gw.discoveredAddrs = addrs
+}
+
+func (gw *Gateway) getDiscoveredAddrs() []string {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return gw.discoveredAddrs
+}
@@ -0,0 +1,105 @@
+package gw
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultBreakerCooldown is the default Settings.BreakerCooldown
+const defaultBreakerCooldown = 10 * time.Second
+
+// BreakerState is the state of the circuit breaker guarding the NATS
+// connections, see Settings.BreakerThreshold
+type BreakerState int
+
+const (
+	// BreakerClosed is the normal state: the NATS server is connected
+	BreakerClosed BreakerState = iota
+	// BreakerOpen means the NATS server is considered down: the websocket
+	// requests are answered with a 503 without connecting it
+	BreakerOpen
+	// BreakerHalfOpen means the cooldown is over: a single request is let
+	// through to probe the NATS server
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// circuitBreaker opens after threshold consecutive failures, rejecting the
+// attempts for cooldown, and then lets one attempt per cooldown through until
+// one succeeds
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	// retryAt is when the next probe is let through, if not closed
+	retryAt time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow tells if an attempt may be made
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerClosed {
+		return true
+	}
+	if now.Before(b.retryAt) {
+		return false
+	}
+	b.state = BreakerHalfOpen
+	b.retryAt = now.Add(b.cooldown)
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = BreakerClosed
+	b.failures = 0
+}
+
+func (b *circuitBreaker) failure(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.retryAt = now.Add(b.cooldown)
+	}
+}
+
+func (b *circuitBreaker) current() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// BreakerState returns the state of the NATS circuit breaker, for health
+// endpoints. It is always BreakerClosed if Settings.BreakerThreshold is not
+// set
+func (gw *Gateway) BreakerState() BreakerState {
+	if gw.breaker == nil {
+		return BreakerClosed
+	}
+	return gw.breaker.current()
+}
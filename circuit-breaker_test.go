@@ -0,0 +1,71 @@
+package gw
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gotest.tools/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := newCircuitBreaker(2, time.Second)
+	assert.Assert(t, breaker.allow(now))
+	breaker.failure(now)
+	assert.Equal(t, BreakerClosed, breaker.current())
+	breaker.failure(now)
+	assert.Equal(t, BreakerOpen, breaker.current())
+	assert.Assert(t, !breaker.allow(now.Add(500*time.Millisecond)))
+
+	// a single probe per cooldown
+	now = now.Add(time.Second)
+	assert.Assert(t, breaker.allow(now))
+	assert.Equal(t, BreakerHalfOpen, breaker.current())
+	assert.Assert(t, !breaker.allow(now))
+	breaker.failure(now)
+	assert.Equal(t, BreakerOpen, breaker.current())
+
+	now = now.Add(time.Second)
+	assert.Assert(t, breaker.allow(now))
+	breaker.success()
+	assert.Equal(t, BreakerClosed, breaker.current())
+	assert.Assert(t, breaker.allow(now))
+}
+
+func TestBreakerThreshold(t *testing.T) {
+	var dials atomic.Int32
+	gateway := NewGateway(Settings{
+		NatsAddr:         "nats:4222",
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Hour,
+		ErrorHandler:     func(error) {},
+		Dialer: func(network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			return nil, errors.New("connection refused")
+		},
+	})
+	server := httptest.NewServer(http.HandlerFunc(gateway.Handler))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for i := 0; i < 2; i++ {
+		wsConn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		assert.NilError(t, err)
+		_, _, err = wsConn.ReadMessage()
+		assert.Assert(t, websocket.IsCloseError(err, websocket.CloseInternalServerErr), "%v", err)
+		wsConn.Close()
+	}
+	assert.Equal(t, BreakerOpen, gateway.BreakerState())
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(2), dials.Load())
+}
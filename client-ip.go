@@ -0,0 +1,99 @@
+package gw
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxies parses a list of CIDRs or single IPs
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy: %s", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy: %s", proxy)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func isTrusted(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range trusted {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP of the client doing the request r, as used by the
+// RateLimiter, according to the TrustForwardedFor and TrustedProxies
+// settings
+func (gw *Gateway) ClientIP(r *http.Request) string {
+	return clientIP(r, gw.settings.TrustForwardedFor, gw.trustedProxies)
+}
+
+// clientIP returns the IP of the client doing the request.
+//
+// If the direct peer is one of the trusted proxies, the X-Forwarded-For
+// addresses are walked from the nearest one, and the first one that is not a
+// trusted proxy is the client IP. Without X-Forwarded-For, X-Real-IP is used.
+// The headers sent by untrusted peers are ignored, as they can be spoofed.
+//
+// Otherwise, the first X-Forwarded-For address is used if trustForwardedFor
+// is set
+func clientIP(r *http.Request, trustForwardedFor bool, trustedProxies []*net.IPNet) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if len(trustedProxies) != 0 {
+		if !isTrusted(peer, trustedProxies) {
+			return peer
+		}
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) != 0 {
+			addrs := strings.Split(strings.Join(forwarded, ","), ",")
+			for i := len(addrs) - 1; i >= 0; i-- {
+				addr := strings.TrimSpace(addrs[i])
+				if addr == "" || isTrusted(addr, trustedProxies) {
+					continue
+				}
+				if net.ParseIP(addr) == nil {
+					// garbage inserted by a client, the real IP is unknown
+					break
+				}
+				return addr
+			}
+			return peer
+		}
+		if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+			return realIP
+		}
+		return peer
+	}
+	if trustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	return peer
+}
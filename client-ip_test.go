@@ -0,0 +1,57 @@
+package gw
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/nats", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 10.0.0.2")
+
+	assert.Equal(t, "10.0.0.1", clientIP(r, false, nil))
+	assert.Equal(t, "1.2.3.4", clientIP(r, true, nil))
+}
+
+func TestClientIPTrustedProxies(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.0.1"})
+	assert.NilError(t, err)
+	for _, tt := range []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		expected   string
+	}{
+		{"no header", "10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"forwarded", "10.0.0.1:1234", "1.2.3.4", "", "1.2.3.4"},
+		{"proxies chain", "10.0.0.1:1234", "1.2.3.4, 192.168.0.1, 10.0.0.2", "", "1.2.3.4"},
+		{"spoofed chain", "10.0.0.1:1234", "6.6.6.6, 1.2.3.4, 10.0.0.2", "", "1.2.3.4"},
+		{"garbage", "10.0.0.1:1234", "1.2.3.4, garbage", "", "10.0.0.1"},
+		{"only proxies", "10.0.0.1:1234", "10.0.0.2", "", "10.0.0.1"},
+		{"real ip", "192.168.0.1:1234", "", "1.2.3.4", "1.2.3.4"},
+		{"untrusted peer", "5.6.7.8:1234", "1.2.3.4", "1.2.3.4", "5.6.7.8"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/nats", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			assert.Equal(t, tt.expected, clientIP(r, true, trusted))
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	_, err := parseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err, "Invalid trusted proxy: 10.0.0.0/33")
+	_, err = parseTrustedProxies([]string{"proxy"})
+	assert.Error(t, err, "Invalid trusted proxy: proxy")
+}
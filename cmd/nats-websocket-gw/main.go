@@ -21,7 +21,8 @@ func init() {
 	flags.Int("port", 8910, "Port to run http server on")
 	flags.String("host", "localhost", "host/IP to run http server on")
 	flags.String("path", "/nats", "webpath of the websocket")
-	flags.String("nats", "localhost:4222", "nats server address:port")
+	flags.String("nats", "localhost:4222", "nats server address:port, or nats:// or tls:// url")
+	flags.String("nats-network", "tcp", "nats server network: tcp or unix")
 	flags.Bool("no-origin-check", false, "Disable websocket origin check")
 	flags.Bool("trace", false, "Enable trace logs")
 
@@ -29,6 +30,7 @@ func init() {
 	viper.BindPFlag("host", flags.Lookup("host"))
 	viper.BindPFlag("path", flags.Lookup("path"))
 	viper.BindPFlag("nats", flags.Lookup("nats"))
+	viper.BindPFlag("nats-network", flags.Lookup("nats-network"))
 	viper.BindPFlag("no-origin-check", flags.Lookup("no-origin-check"))
 	viper.BindPFlag("trace", flags.Lookup("trace"))
 }
@@ -36,7 +38,8 @@ func init() {
 func rootCmdRun(cmd *cobra.Command, args []string) {
 
 	settings := gw.Settings{
-		NatsAddr: viper.GetString("nats"),
+		NatsAddr:    viper.GetString("nats"),
+		NatsNetwork: viper.GetString("nats-network"),
 	}
 
 	if viper.GetBool("no-origin-check") {
@@ -52,7 +55,11 @@ func rootCmdRun(cmd *cobra.Command, args []string) {
 
 	listenOn := viper.GetString("host") + ":" + viper.GetString("port")
 
-	gateway := gw.NewGateway(settings)
+	gateway, err := gw.NewGatewayWithValidation(settings)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	http.HandleFunc(viper.GetString("path"), gateway.Handler)
 	http.ListenAndServe(listenOn, nil)
 }
@@ -8,34 +8,140 @@ import (
 	"strconv"
 )
 
-// CommandsReader parses a NATS connection input stream into commands
+// CommandsReader parses a NATS connection input stream into commands.
+//
+// The input stream is read through an internal bufio.Reader, so a
+// CommandsReader must be the only reader of its source once created, and
+// may hold data that was read from the source but not yet returned.
+//
+// Commands are framed as follows:
+//
+//   - control lines (INFO, PING, PONG, -ERR...) are delimited by '\r\n' and
+//     returned with their trailing '\r\n'
+//   - for MSG, PUB, HMSG and HPUB, the control line is followed by a payload
+//     whose size is the last argument of the control line (for HMSG and
+//     HPUB, the payload starts with the headers, whose size is the previous
+//     argument). The payload is read
+//     according to that exact size, so it may contain any byte including
+//     '\r\n', and the command is returned as the control line followed by
+//     the payload and its trailing '\r\n'
+//   - '+OK' and '-ERR' are control lines too, so each of them is returned
+//     as a separate command
+//   - empty lines between commands are skipped
+//
+// A command bigger than the reader maximum command size, if any, is rejected
+// with a *CommandTooLargeError before being read in memory.
 type CommandsReader struct {
 	io.Reader
-	br *bufio.Reader
+	br             *bufio.Reader
+	maxCommandSize int
+	// maxControlLine and maxPayload bound the commands of a client, if > 0.
+	// See newClientCommandsReader
+	maxControlLine int
+	maxPayload     int64
 }
 
-// NewCommandsReader creates a CommandsReader
+// NewCommandsReader creates a CommandsReader reading from src, with the
+// default buffer size and no maximum command size
 func NewCommandsReader(src io.Reader) CommandsReader {
+	return NewCommandsReaderSize(src, 0, 0)
+}
+
+// NewCommandsReaderSize creates a CommandsReader reading from src through a
+// buffer of the given size (the bufio default if <= 0). If maxCommandSize is
+// > 0, commands bigger than maxCommandSize bytes are rejected.
+//
+// A control line longer than the buffer is read in several chunks, and
+// copied in a growing slice. A buffer bigger than the usual control lines
+// avoids that, and one bigger than the usual messages lets the payloads be
+// read at once. A small buffer saves memory when there are many idle
+// connections carrying small messages
+func NewCommandsReaderSize(src io.Reader, size, maxCommandSize int) CommandsReader {
+	var br *bufio.Reader
+	if size > 0 {
+		br = bufio.NewReaderSize(src, size)
+	} else {
+		br = bufio.NewReader(src)
+	}
 	return CommandsReader{
-		Reader: src,
-		br:     bufio.NewReader(src),
+		Reader:         src,
+		br:             br,
+		maxCommandSize: maxCommandSize,
 	}
 }
 
-// NextCommand returns the next command in the input stream
-func (cr CommandsReader) NextCommand() ([]byte, error) {
-	return cr.nextCommand()
+// NewCommandsReaderFrom creates a CommandsReader reading from an already
+// configured bufio.Reader, which may hold buffered data. If maxCommandSize
+// is > 0, commands bigger than maxCommandSize bytes are rejected
+func NewCommandsReaderFrom(br *bufio.Reader, maxCommandSize int) CommandsReader {
+	return CommandsReader{
+		Reader:         br,
+		br:             br,
+		maxCommandSize: maxCommandSize,
+	}
+}
+
+// newClientCommandsReader creates a CommandsReader for the stream of a
+// websocket client. It rejects the control lines longer than maxControlLine
+// with ErrMaxControlLine, and the PUB and HPUB whose payload is bigger than
+// maxPayload with a *MaxPayloadError, before reading them in memory. The
+// buffer is maxControlLine long, so that a control line without '\n' is
+// rejected as soon as it exceeds the limit
+func newClientCommandsReader(src io.Reader, maxControlLine int, maxPayload int64) CommandsReader {
+	cr := NewCommandsReaderSize(src, maxControlLine, 0)
+	cr.maxControlLine = maxControlLine
+	cr.maxPayload = maxPayload
+	return cr
+}
+
+// Buffered returns the number of bytes read from the source but not yet
+// returned
+func (cr CommandsReader) Buffered() int {
+	return cr.br.Buffered()
 }
 
-func (cr CommandsReader) nextCommand() ([]byte, error) {
+// readLine reads a line up to its '\n', checking its size against the
+// maximum command size as it grows
+func (cr CommandsReader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := cr.br.ReadSlice('\n')
+		if cr.maxCommandSize > 0 && len(line)+len(chunk) > cr.maxCommandSize {
+			return nil, &CommandTooLargeError{
+				Size:           len(line) + len(chunk),
+				MaxCommandSize: cr.maxCommandSize,
+			}
+		}
+		line = append(line, chunk...)
+		if cr.maxControlLine > 0 && (len(line) > cr.maxControlLine ||
+			err == bufio.ErrBufferFull && len(line) == cr.maxControlLine) {
+			return nil, ErrMaxControlLine
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// Read reads raw bytes from the input stream, starting with the data already
+// buffered, if any. It must not be mixed with NextCommand, unless at
+// command boundaries
+func (cr CommandsReader) Read(p []byte) (int, error) {
+	return cr.br.Read(p)
+}
+
+// NextCommand returns the next command in the input stream. It blocks until
+// a whole command is available, and returns the underlying reader error if
+// any (io.EOF at the end of the stream)
+func (cr CommandsReader) NextCommand() ([]byte, error) {
 	var msg []byte
 
-	line, err := cr.br.ReadBytes('\n')
+	line, err := cr.readLine()
 	if err != nil {
 		return nil, err
 	}
 	for bytes.Equal(line, []byte("\r\n")) {
-		line, err = cr.br.ReadBytes('\n')
+		line, err = cr.readLine()
 		if err != nil {
 			return nil, err
 		}
@@ -47,35 +153,87 @@ func (cr CommandsReader) nextCommand() ([]byte, error) {
 	if len(line) < 3 {
 		return nil, fmt.Errorf("Invalid command: %v", line)
 	}
-	op := line[0:3]
+	op, _ := splitCommand(line)
 	switch {
-	case bytes.Equal(op, []byte("MSG")),
-		bytes.Equal(op, []byte("PUB")):
-		// msg = line[:]
-		splitted := bytes.Split(line, []byte(" "))
-		sizeStr := splitted[len(splitted)-1]
-		sizeStr = sizeStr[:len(sizeStr)-2]
-		size, err := strconv.Atoi(string(sizeStr))
+	case op == "MSG", op == "PUB", op == "HMSG", op == "HPUB":
+		size, err := payloadSize(line)
 		if err != nil {
-			return nil, fmt.Errorf("Error reading %s size: %s", op, err)
+			return nil, err
+		}
+		if cr.maxPayload > 0 && int64(size) > cr.maxPayload {
+			return nil, &MaxPayloadError{Size: int64(size), MaxPayload: cr.maxPayload}
 		}
-		// the '-2' is to account for the trailing \r\n which is after the payload
-		for size > -2 {
-			chunk, err := cr.br.ReadBytes('\n')
-			if err != nil {
-				return nil, fmt.Errorf("Error reading %s payload: %s", op, err)
+		if total := len(line) + size + 2; cr.maxCommandSize > 0 && total > cr.maxCommandSize {
+			return nil, &CommandTooLargeError{
+				Size:           total,
+				MaxCommandSize: cr.maxCommandSize,
 			}
-			size -= len(chunk)
-			msg = append(msg, chunk...)
 		}
-		if size != -2 {
-			return nil, fmt.Errorf(
-				"Error reading %s payload. Got %d extra bytes", op, -size-2)
+		// the payload is followed by a \r\n, and may itself contain any
+		// byte, including \r\n, so it is read by size
+		msg = make([]byte, len(line)+size+2)
+		copy(msg, line)
+		if _, err := io.ReadFull(cr.br, msg[len(line):]); err != nil {
+			return nil, fmt.Errorf("Error reading %s payload: %w", op, err)
+		}
+		if !bytes.HasSuffix(msg, []byte("\r\n")) {
+			return nil, fmt.Errorf("Error reading %s payload: %w", op, ErrMissingCRLF)
 		}
-	case bytes.Equal(op, []byte("+OK")):
 	default:
 		msg = line
 	}
 
 	return msg, nil
 }
+
+// payloadSize returns the payload size declared by a MSG, PUB, HMSG or HPUB
+// control line, which is its last argument. For HMSG and HPUB, the size
+// includes the headers, and is checked against the headers size
+func payloadSize(line []byte) (int, error) {
+	splitted := bytes.Split(bytes.TrimRight(line, "\r\n"), []byte(" "))
+	op := splitted[0]
+	sizeStr := splitted[len(splitted)-1]
+	size, err := strconv.Atoi(string(sizeStr))
+	if err != nil {
+		return 0, fmt.Errorf("Error reading %s size: %s", op, err)
+	}
+	if size < 0 {
+		return 0, fmt.Errorf("Error reading %s size: negative size %d", op, size)
+	}
+	if op[0] == 'H' || op[0] == 'h' {
+		if len(splitted) < 3 {
+			return 0, fmt.Errorf("Error reading %s headers size: missing", op)
+		}
+		hdrSize, err := strconv.Atoi(string(splitted[len(splitted)-2]))
+		if err != nil {
+			return 0, fmt.Errorf("Error reading %s headers size: %s", op, err)
+		}
+		if hdrSize < 0 || hdrSize > size {
+			return 0, fmt.Errorf(
+				"Error reading %s headers size: %d is not within 0-%d", op, hdrSize, size)
+		}
+	}
+	return size, nil
+}
+
+// ParseErr tells if cmd is a '-ERR' command, and returns its reason without
+// the quotes
+func ParseErr(cmd []byte) (string, bool) {
+	if !bytes.HasPrefix(cmd, []byte("-ERR")) {
+		return "", false
+	}
+	reason := bytes.TrimSpace(cmd[len("-ERR"):])
+	reason = bytes.TrimPrefix(reason, []byte("'"))
+	reason = bytes.TrimSuffix(reason, []byte("'"))
+	return string(reason), true
+}
+
+// splitCommand splits a control line into its upper-cased operation and its
+// arguments
+func splitCommand(line []byte) (string, [][]byte) {
+	fields := bytes.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return string(bytes.ToUpper(fields[0])), fields[1:]
+}
@@ -1,8 +1,13 @@
 package gw
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"gotest.tools/assert"
 )
@@ -24,10 +29,85 @@ func TestCommandsReader(t *testing.T) {
 			},
 			expected: []string{
 				"INFO {}\r\n",
-				"123\r\n",
-				"1\r\n\r\n",
-				"1\r\n\r\n",
+				"MSG test 1 3\r\n123\r\n",
+				"MSG test 1 3\r\n1\r\n\r\n",
+				"PUB test 3\r\n1\r\n\r\n",
+			},
+		},
+		{
+			name: "embedded newlines",
+			commands: []string{
+				"MSG test 1 reply 6\r\n\r\n\r\n\r\n\r\n",
+				"MSG test 1 3\r\na\nb\r\n",
+				"MSG test 1 4\r\n\n\n\r\r\r\n",
+				"PING\r\n",
+			},
+			expected: []string{
+				"MSG test 1 reply 6\r\n\r\n\r\n\r\n\r\n",
+				"MSG test 1 3\r\na\nb\r\n",
+				"MSG test 1 4\r\n\n\n\r\r\r\n",
+				"PING\r\n",
+			},
+		},
+		{
+			name: "binary payload",
+			commands: []string{
+				"MSG test 1 4\r\n\x00\xff\r\x00\r\n",
+				"HMSG test 1 12 14\r\nNATS/1.0\r\n\r\nhi\r\n",
+			},
+			expected: []string{
+				"MSG test 1 4\r\n\x00\xff\r\x00\r\n",
+				"HMSG test 1 12 14\r\nNATS/1.0\r\n\r\nhi\r\n",
+			},
+		},
+		{
+			name: "headers",
+			commands: []string{
+				"HMSG test 1 reply 26 28\r\nNATS/1.0\r\nA: 1\r\nB: two\r\n\r\nhi\r\n",
+				"HPUB test 26 26\r\nNATS/1.0\r\nA: 1\r\nB: two\r\n\r\n\r\n",
+				"MSG test 1 0\r\n\r\n",
 			},
+			expected: []string{
+				"HMSG test 1 reply 26 28\r\nNATS/1.0\r\nA: 1\r\nB: two\r\n\r\nhi\r\n",
+				"HPUB test 26 26\r\nNATS/1.0\r\nA: 1\r\nB: two\r\n\r\n\r\n",
+				"MSG test 1 0\r\n\r\n",
+			},
+		},
+		{
+			name: "headers bigger than total",
+			commands: []string{
+				"HMSG test 1 20 10\r\n0123456789\r\n",
+			},
+			err: "Error reading HMSG headers size: 20 is not within 0-10",
+		},
+		{
+			name: "verbose",
+			commands: []string{
+				"+OK\r\n",
+				"+OK\r\n-ERR 'Unknown Subject'\r\nMSG test 1 2\r\nok\r\n",
+				"-ERR 'Authorization Violation'\r\n",
+			},
+			expected: []string{
+				"+OK\r\n",
+				"+OK\r\n",
+				"-ERR 'Unknown Subject'\r\n",
+				"MSG test 1 2\r\nok\r\n",
+				"-ERR 'Authorization Violation'\r\n",
+			},
+		},
+		{
+			name: "wrong size",
+			commands: []string{
+				"MSG test 1 2\r\n123\r\n",
+			},
+			err: "Error reading MSG payload: missing trailing CRLF",
+		},
+		{
+			name: "truncated payload",
+			commands: []string{
+				"MSG test 1 10\r\n123\r\n",
+			},
+			err: "Error reading MSG payload: unexpected EOF",
 		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
@@ -37,13 +117,13 @@ func TestCommandsReader(t *testing.T) {
 			}
 			reader := NewCommandsReader(&buf)
 			for _, expected := range tt.expected {
-				next, err := reader.nextCommand()
+				next, err := reader.NextCommand()
 				if err != nil {
 					t.Fatal(err)
 				}
 				assert.Equal(t, expected, string(next))
 			}
-			_, err := reader.nextCommand()
+			_, err := reader.NextCommand()
 			if err == nil {
 				t.Fatal("Expected an error")
 			}
@@ -55,3 +135,112 @@ func TestCommandsReader(t *testing.T) {
 		})
 	}
 }
+
+func TestCommandsReaderMaxCommandSize(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		input string
+		size  int
+	}{
+		{"fits", "MSG test 1 3\r\nabc\r\n", 0},
+		{"long control line", "INFO {\"server_id\":\"0123456789abcdef\"}\r\n", 39},
+		{"big payload", "MSG test 1 100\r\n", 118},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := NewCommandsReaderSize(strings.NewReader(tt.input), 16, 32)
+			cmd, err := reader.NextCommand()
+			if tt.size == 0 {
+				assert.NilError(t, err)
+				assert.Equal(t, tt.input, string(cmd))
+				return
+			}
+			tooLarge, ok := err.(*CommandTooLargeError)
+			assert.Assert(t, ok, "unexpected error: %v", err)
+			assert.Equal(t, tt.size, tooLarge.Size)
+			assert.Equal(t, 32, tooLarge.MaxCommandSize)
+		})
+	}
+}
+
+func TestCommandsReaderSplitReads(t *testing.T) {
+	// a clustered server INFO, bigger than the reader buffer
+	var urls []string
+	for i := 0; i < 100; i++ {
+		urls = append(urls, fmt.Sprintf("\"10.0.0.%d:4222\"", i))
+	}
+	info := "INFO {\"connect_urls\":[" + strings.Join(urls, ",") + "]}\r\n"
+	input := info + "MSG test 1 4\r\n\r\n\r\n\r\n" + "PING\r\n"
+
+	reader := NewCommandsReaderSize(iotest.OneByteReader(strings.NewReader(input)), 16, 0)
+	for _, expected := range []string{info, "MSG test 1 4\r\n\r\n\r\n\r\n", "PING\r\n"} {
+		cmd, err := reader.NextCommand()
+		assert.NilError(t, err)
+		assert.Equal(t, expected, string(cmd))
+	}
+}
+
+func TestClientCommandsReader(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		input    string
+		expected []string
+		err      error
+	}{
+		{"commands", "PUB foo 7\r\nhi\r\nPUB\r\nSUB foo 1\r\n",
+			[]string{"PUB foo 7\r\nhi\r\nPUB\r\n", "SUB foo 1\r\n"}, nil},
+		{"long line", "SUB " + strings.Repeat("x", 60) + " 1\r\n", nil, ErrMaxControlLine},
+		{"no newline", strings.Repeat("x", 32), nil, ErrMaxControlLine},
+		{"max payload", "PUB foo 10\r\n0123456789\r\nPUB foo 11\r\n",
+			[]string{"PUB foo 10\r\n0123456789\r\n"}, ErrMaxPayload},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := newClientCommandsReader(iotest.OneByteReader(strings.NewReader(tt.input)), 32, 10)
+			for _, expected := range tt.expected {
+				cmd, err := reader.NextCommand()
+				assert.NilError(t, err)
+				assert.Equal(t, expected, string(cmd))
+			}
+			if tt.err != nil {
+				_, err := reader.NextCommand()
+				assert.Assert(t, errors.Is(err, tt.err), err)
+			}
+		})
+	}
+}
+
+func TestCommandsReaderFrom(t *testing.T) {
+	br := bufio.NewReaderSize(strings.NewReader("INFO {}\r\nPING\r\nPONG\r\n"), 16)
+	// data already buffered by the caller is not lost
+	peeked, err := br.Peek(4)
+	assert.NilError(t, err)
+	assert.Equal(t, "INFO", string(peeked))
+
+	reader := NewCommandsReaderFrom(br, 0)
+	cmd, err := reader.NextCommand()
+	assert.NilError(t, err)
+	assert.Equal(t, "INFO {}\r\n", string(cmd))
+	assert.Equal(t, 7, reader.Buffered())
+	cmd, err = reader.NextCommand()
+	assert.NilError(t, err)
+	assert.Equal(t, "PING\r\n", string(cmd))
+	assert.Equal(t, 1, reader.Buffered())
+}
+
+func TestParseErr(t *testing.T) {
+	for _, tt := range []struct {
+		cmd    string
+		reason string
+		ok     bool
+	}{
+		{"-ERR 'Authorization Violation'\r\n", "Authorization Violation", true},
+		{"-ERR 'Permissions Violation for Publish to \"foo\"'\r\n",
+			"Permissions Violation for Publish to \"foo\"", true},
+		{"-ERR\r\n", "", true},
+		{"+OK\r\n", "", false},
+		{"PING\r\n", "", false},
+	} {
+		reason, ok := ParseErr([]byte(tt.cmd))
+		assert.Equal(t, tt.ok, ok, tt.cmd)
+		assert.Equal(t, tt.reason, reason, tt.cmd)
+	}
+}
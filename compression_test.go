@@ -0,0 +1,148 @@
+package gw
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"gotest.tools/assert"
+)
+
+// countingConn counts the bytes read from a connection
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+// dialCompressed opens a websocket to a gateway started by newTestGateway,
+// negotiating the compression if compress is set. The bytes received on the
+// wire are counted in read
+func dialCompressed(t testing.TB, url string, compress bool, read *atomic.Int64) *websocket.Conn {
+	dialer := websocket.Dialer{
+		EnableCompression: compress,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			return countingConn{Conn: conn, read: read}, err
+		},
+	}
+	wsConn, _, err := dialer.Dial("ws"+strings.TrimPrefix(url, "http"), nil)
+	assert.NilError(t, err)
+	t.Cleanup(func() { wsConn.Close() })
+	return wsConn
+}
+
+func jsonPayload(size int) string {
+	var b strings.Builder
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, `{"id":%d,"name":"item","tags":["a","b"]},`, i)
+	}
+	return b.String()[:size]
+}
+
+func TestCompression(t *testing.T) {
+	payload := jsonPayload(10000)
+	msg := fmt.Sprintf("MSG test 1 %d\r\n%s\r\n", len(payload), payload)
+	pub := fmt.Sprintf("PUB test %d\r\n%s\r\n", len(payload), payload)
+	for _, mode := range []string{"text", "binary"} {
+		t.Run(mode, func(t *testing.T) {
+			received := make(chan string, 1)
+			server := newTestGateway(t, Settings{EnableCompression: true}, func(conn net.Conn) {
+				conn.Write([]byte("INFO {}\r\n" + msg))
+				cmd, _ := NewCommandsReader(conn).NextCommand()
+				received <- string(cmd)
+			})
+			var read atomic.Int64
+			wsConn := dialCompressed(t, server.URL+"?mode="+mode, true, &read)
+			assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+			assert.Equal(t, msg, readWSMessage(t, wsConn))
+			assert.Assert(t, read.Load() < int64(len(msg)/2), "%d bytes read", read.Load())
+
+			messageType := websocket.TextMessage
+			if mode == "binary" {
+				messageType = websocket.BinaryMessage
+			}
+			wsConn.EnableWriteCompression(true)
+			assert.NilError(t, wsConn.WriteMessage(messageType, []byte(pub)))
+			assert.Equal(t, pub, <-received)
+		})
+	}
+}
+
+func TestCompressionNegotiated(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		enabled  bool
+		offered  bool
+		expected bool
+	}{
+		{"negotiated", true, true, true},
+		{"not offered", true, false, false},
+		{"not enabled", false, true, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := &fakeMetrics{bytes: make(map[string]int64)}
+			compressed := make(chan bool, 1)
+			server := newTestGateway(t, Settings{
+				EnableCompression: tt.enabled,
+				Metrics:           metrics,
+				OnConnect: func(r *http.Request, natsConn *NatsConn) {
+					compressed <- natsConn.Compressed
+				},
+			}, func(conn net.Conn) {
+				conn.Write([]byte("INFO {}\r\n"))
+				conn.Read(make([]byte, 1))
+			})
+			var read atomic.Int64
+			wsConn := dialCompressed(t, server.URL, tt.offered, &read)
+			readWSMessage(t, wsConn)
+			assert.Equal(t, tt.expected, <-compressed)
+			expected := 0
+			if tt.expected {
+				expected = 1
+			}
+			assert.Equal(t, expected, metrics.snapshot().compressed)
+		})
+	}
+}
+
+func BenchmarkCompression(b *testing.B) {
+	payload := jsonPayload(4096)
+	msg := []byte(fmt.Sprintf("MSG test 1 %d\r\n%s\r\n", len(payload), payload))
+	for _, compress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compress=%v", compress), func(b *testing.B) {
+			next := make(chan struct{})
+			server := newTestGateway(b, Settings{EnableCompression: compress, Logger: &testLogger{}}, func(conn net.Conn) {
+				conn.Write([]byte("INFO {}\r\n"))
+				for range next {
+					conn.Write(msg)
+				}
+			})
+			defer close(next)
+			var read atomic.Int64
+			wsConn := dialCompressed(b, server.URL, compress, &read)
+			if _, _, err := wsConn.ReadMessage(); err != nil {
+				b.Fatal(err)
+			}
+			read.Store(0)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				next <- struct{}{}
+				if _, _, err := wsConn.ReadMessage(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(read.Load())/float64(b.N), "wire-bytes/op")
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package gw
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultPoolSize is the default Settings.PoolSize
+const defaultPoolSize = 16
+
+// defaultPoolIdleTimeout is the default Settings.PoolIdleTimeout. It is well
+// below the default NATS ping interval, so that an idle connection does not
+// miss the server PINGs for too long
+const defaultPoolIdleTimeout = 30 * time.Second
+
+// poolResetTimeout bounds the reset of a connection before it is pooled, and
+// its check before it is reused
+const poolResetTimeout = time.Second
+
+// ConnPool keeps the NATS connections of the ended websocket sessions, and
+// hands them to the following sessions, see Settings.ReuseConnections
+type ConnPool struct {
+	size        int
+	idleTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   []pooledConn
+	closed bool
+}
+
+type pooledConn struct {
+	conn  *NatsConn
+	since time.Time
+}
+
+func newConnPool(size int, idleTimeout time.Duration) *ConnPool {
+	if size <= 0 {
+		size = defaultPoolSize
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = defaultPoolIdleTimeout
+	}
+	return &ConnPool{size: size, idleTimeout: idleTimeout}
+}
+
+// Len returns the number of idle connections in the pool
+func (p *ConnPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+// Close closes the idle connections. The connections released afterwards are
+// closed instead of being pooled
+func (p *ConnPool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+	for _, pooled := range idle {
+		pooled.conn.Close()
+	}
+}
+
+// get returns the most recently pooled connection, or nil if there is none.
+// The expired connections are closed
+func (p *ConnPool) get() *NatsConn {
+	p.mu.Lock()
+	var expired []pooledConn
+	var conn *NatsConn
+	for len(p.idle) != 0 {
+		pooled := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if time.Since(pooled.since) > p.idleTimeout {
+			expired = append(expired, pooled)
+			continue
+		}
+		conn = pooled.conn
+		break
+	}
+	p.mu.Unlock()
+	for _, pooled := range expired {
+		pooled.conn.Close()
+	}
+	return conn
+}
+
+// put adds a connection to the pool, or closes it if the pool is full or
+// closed
+func (p *ConnPool) put(conn *NatsConn) {
+	p.mu.Lock()
+	if p.closed || len(p.idle) >= p.size {
+		p.mu.Unlock()
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, pooledConn{conn: conn, since: time.Now()})
+	p.mu.Unlock()
+}
+
+// ConnPool returns the pool of the NATS connections, nil unless
+// Settings.ReuseConnections is set
+func (gw *Gateway) ConnPool() *ConnPool {
+	return gw.pool
+}
+
+// acquireNatsConn returns a pooled NATS connection if any, or opens a new one.
+// The pooled connections are checked first, the dead ones (for example
+// after a NATS restart) being closed
+func (gw *Gateway) acquireNatsConn(r *http.Request) (*NatsConn, error) {
+	if gw.pool != nil {
+		for natsConn := gw.pool.get(); natsConn != nil; natsConn = gw.pool.get() {
+			if err := resetNatsConn(natsConn, nil); err != nil {
+				if gw.settings.Trace {
+					gw.logger.Tracef("Not reusing a dead NATS connection: %s", err)
+				}
+				natsConn.Close()
+				continue
+			}
+			return natsConn, nil
+		}
+	}
+	return gw.connectNats(r.Context(), r)
+}
+
+// reusable tells if the NATS connection of a pair that ended with err can be
+// pooled: only the client disconnections leave it in a known state
+func reusable(err error) bool {
+	var closeErr *websocket.CloseError
+	return errors.As(err, &closeErr) || errors.Is(err, context.Canceled)
+}
+
+// releaseNatsConn resets the NATS connection of an ended pair, then pools it.
+// The subscriptions of the client are removed, and a PING/PONG exchange
+// makes sure the messages received meanwhile are discarded. The connection
+// is closed if anything goes wrong
+func (gw *Gateway) releaseNatsConn(pair *connPair) {
+	natsConn := pair.natsConn
+	// the session is over, its OnFrame does not see the reset
+	natsConn.onFrame = nil
+	natsConn.ClientConnect = nil
+	natsConn.ClientCloseCode, natsConn.ClientCloseText = 0, ""
+	if err := resetNatsConn(natsConn, pair.subs); err != nil {
+		if gw.settings.Trace {
+			gw.logger.Tracef("Not reusing the NATS connection: %s", err)
+		}
+		natsConn.Close()
+		return
+	}
+	// the INFO of the first session, forwarded to the next clients, must
+	// not tell them a client id or a nonce that are not theirs
+	natsConn.ServerInfo = stripInfo(natsConn.ServerInfo, "client_id", "nonce")
+	natsConn.Info.ClientID = 0
+	natsConn.Info.Nonce = ""
+	gw.pool.put(natsConn)
+}
+
+// stripInfo removes fields from an INFO json
+func stripInfo(info NatsServerInfo, fields ...string) NatsServerInfo {
+	var parsed map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(info), &parsed); err != nil {
+		return info
+	}
+	for _, field := range fields {
+		delete(parsed, field)
+	}
+	stripped, err := json.Marshal(parsed)
+	if err != nil {
+		return info
+	}
+	return NatsServerInfo(stripped)
+}
+
+func resetNatsConn(natsConn *NatsConn, subs map[string]struct{}) error {
+	natsConn.Conn.SetDeadline(time.Now().Add(poolResetTimeout))
+	for sid := range subs {
+		if err := natsConn.writeCommand([]byte("UNSUB " + sid + "\r\n")); err != nil {
+			return err
+		}
+	}
+	if err := natsConn.writeCommand([]byte("PING\r\n")); err != nil {
+		return err
+	}
+	for {
+		cmd, err := natsConn.CmdReader.NextCommand()
+		if err != nil {
+			return err
+		}
+		if reason, ok := ParseErr(cmd); ok {
+			return fmt.Errorf("NATS server error: %s", reason)
+		}
+		if bytes.Equal(cmd, []byte("PONG\r\n")) {
+			break
+		}
+	}
+	return natsConn.Conn.SetDeadline(time.Time{})
+}
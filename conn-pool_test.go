@@ -0,0 +1,101 @@
+package gw
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gotest.tools/assert"
+)
+
+func TestReuseConnections(t *testing.T) {
+	var dials int
+	var upstreams []net.Conn
+	received := make(chan string, 100)
+	gateway := NewGateway(Settings{
+		NatsAddr:         "nats:4222",
+		ErrorHandler:     func(error) {},
+		ReuseConnections: true,
+		Dialer: func(network, addr string) (net.Conn, error) {
+			dials++
+			client, server := net.Pipe()
+			upstreams = append(upstreams, server)
+			go func() {
+				defer server.Close()
+				server.Write([]byte("INFO {}\r\n"))
+				reader := bufio.NewReader(server)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					received <- line
+					if line == "PING\r\n" {
+						server.Write([]byte("MSG foo 1 2\r\nhi\r\nPONG\r\n"))
+					}
+				}
+			}()
+			return client, nil
+		},
+	})
+	server := httptest.NewServer(http.HandlerFunc(gateway.Handler))
+	defer server.Close()
+
+	session := func(cmds ...string) {
+		wsConn, _, err := websocket.DefaultDialer.Dial(
+			"ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		assert.NilError(t, err)
+		defer wsConn.Close()
+		assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+		for _, cmd := range cmds {
+			assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte(cmd)))
+			line := <-received
+			if line == "PING\r\n" {
+				// the check of a reused connection
+				line = <-received
+			}
+			assert.Equal(t, cmd, line)
+		}
+		wsConn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	}
+	waitPooled := func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for gateway.ConnPool().Len() != 1 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, 1, gateway.ConnPool().Len())
+	}
+
+	session("SUB foo 1\r\n", "SUB bar 2\r\n", "UNSUB 2\r\n")
+	waitPooled()
+	// the remaining subscription is removed before pooling
+	assert.Equal(t, "UNSUB 1\r\n", <-received)
+	assert.Equal(t, "PING\r\n", <-received)
+
+	session("SUB foo 1\r\n")
+	waitPooled()
+	assert.Equal(t, 1, dials)
+	assert.Equal(t, "UNSUB 1\r\n", <-received)
+	assert.Equal(t, "PING\r\n", <-received)
+
+	// a pooled connection closed meanwhile is replaced
+	upstreams[0].Close()
+	session("SUB foo 1\r\n")
+	waitPooled()
+	assert.Equal(t, 2, dials)
+
+	assert.NilError(t, gateway.Shutdown(context.Background()))
+	assert.Equal(t, 0, gateway.ConnPool().Len())
+}
+
+func TestStripInfo(t *testing.T) {
+	assert.Equal(t, NatsServerInfo(`{"max_payload":1024}`),
+		stripInfo(`{"client_id":3,"nonce":"abc","max_payload":1024}`, "client_id", "nonce"))
+}
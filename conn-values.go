@@ -0,0 +1,61 @@
+package gw
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// connValuesKey is the context key of the values of a websocket request
+type connValuesKey struct{}
+
+// connValues holds the values stored with SetConnValue
+type connValues struct {
+	mu     sync.Mutex
+	values map[interface{}]interface{}
+}
+
+// withConnValues returns r carrying an empty set of values
+func withConnValues(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), connValuesKey{}, &connValues{}))
+}
+
+// SetConnValue stores a value for the rest of the handling of a websocket
+// request. It is meant for PreUpgrade to pass what it computed, like a
+// resolved tenant or an authenticated user, to the hooks called later with
+// the request: ConnectHandler, ConnectBuilder, AuthorizeSubject, OnConnect
+// and OnClose. Like for context.WithValue, the keys should be of a type of
+// the calling package:
+//
+//	type tenantKey struct{}
+//
+//	settings.PreUpgrade = func(w http.ResponseWriter, r *http.Request) bool {
+//		gw.SetConnValue(r, tenantKey{}, r.URL.Query().Get("tenant"))
+//		return true
+//	}
+//
+// It returns false if r is not a request handled by a Gateway
+func SetConnValue(r *http.Request, key, value interface{}) bool {
+	values, ok := r.Context().Value(connValuesKey{}).(*connValues)
+	if !ok {
+		return false
+	}
+	values.mu.Lock()
+	defer values.mu.Unlock()
+	if values.values == nil {
+		values.values = make(map[interface{}]interface{})
+	}
+	values.values[key] = value
+	return true
+}
+
+// ConnValue returns the value stored for key with SetConnValue, or nil
+func ConnValue(r *http.Request, key interface{}) interface{} {
+	values, ok := r.Context().Value(connValuesKey{}).(*connValues)
+	if !ok {
+		return nil
+	}
+	values.mu.Lock()
+	defer values.mu.Unlock()
+	return values.values[key]
+}
@@ -0,0 +1,71 @@
+package gw
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"gotest.tools/assert"
+)
+
+type testTenantKey struct{}
+
+func TestConnValue(t *testing.T) {
+	r := httptest.NewRequest("GET", "/nats", nil)
+	assert.Assert(t, !SetConnValue(r, testTenantKey{}, "acme"))
+	assert.Assert(t, ConnValue(r, testTenantKey{}) == nil)
+
+	r = withConnValues(r)
+	assert.Assert(t, ConnValue(r, testTenantKey{}) == nil)
+	assert.Assert(t, SetConnValue(r, testTenantKey{}, "acme"))
+	assert.Equal(t, "acme", ConnValue(r, testTenantKey{}))
+}
+
+// TestTenantConnect resolves a tenant in PreUpgrade and authenticates the
+// connection for it in the ConnectHandler
+func TestTenantConnect(t *testing.T) {
+	tokens := map[string]string{"acme.example.com": "acme-token"}
+	connect := make(chan string, 1)
+	server := newTestGateway(t, Settings{
+		PreUpgrade: func(w http.ResponseWriter, r *http.Request) bool {
+			tenant, ok := tokens[r.Host]
+			if !ok {
+				http.Error(w, "unknown tenant", http.StatusNotFound)
+				return false
+			}
+			SetConnValue(r, testTenantKey{}, tenant)
+			return true
+		},
+		ConnectHandler: func(natsConn *NatsConn, r *http.Request, wsConn *websocket.Conn) error {
+			token, _ := ConnValue(r, testTenantKey{}).(string)
+			if err := writeConnect(natsConn, map[string]string{"auth_token": token}); err != nil {
+				return err
+			}
+			return natsConn.forwardInfo(wsConn)
+		},
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		connect <- line
+		conn.Read(make([]byte, 1))
+	})
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Host": {"unknown.example.com"}})
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	wsConn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Host": {"acme.example.com"}})
+	assert.NilError(t, err)
+	defer wsConn.Close()
+	var options map[string]string
+	line := <-connect
+	assert.NilError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "CONNECT ")), &options))
+	assert.DeepEqual(t, map[string]string{"auth_token": "acme-token"}, options)
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+}
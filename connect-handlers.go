@@ -0,0 +1,148 @@
+package gw
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeConnect sends a CONNECT command carrying the json encoded options to
+// the NATS server
+func writeConnect(natsConn *NatsConn, options interface{}) error {
+	data, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	cmd := append([]byte("CONNECT "), data...)
+	cmd = append(cmd, '\r', '\n')
+	return natsConn.writeCommand(cmd)
+}
+
+// checkConnect sends a PING after a CONNECT and waits for the PONG. A -ERR
+// answer means the CONNECT was rejected
+func checkConnect(natsConn *NatsConn) error {
+	if err := natsConn.writeCommand([]byte("PING\r\n")); err != nil {
+		return err
+	}
+	for {
+		cmd, err := natsConn.CmdReader.NextCommand()
+		if err != nil {
+			return err
+		}
+		if reason, ok := ParseErr(cmd); ok {
+			return fmt.Errorf("%w: %s", ErrAuthorization, reason)
+		}
+		if bytes.HasPrefix(cmd, []byte("PONG")) {
+			return nil
+		}
+		// ignore anything else, like +OK
+	}
+}
+
+// TokenConnectHandler returns a ConnectHandler that authenticates to the NATS
+// server with a static token, then forwards the INFO to the client
+func TokenConnectHandler(token string) ConnectHandler {
+	return func(natsConn *NatsConn, r *http.Request, wsConn *websocket.Conn) error {
+		if err := writeConnect(natsConn, struct {
+			AuthToken string `json:"auth_token"`
+		}{token}); err != nil {
+			return err
+		}
+		return natsConn.forwardInfo(wsConn)
+	}
+}
+
+// UserPassConnectHandler returns a ConnectHandler that authenticates to the
+// NATS server with a user and password if the server requires it, then
+// forwards the INFO to the client
+func UserPassConnectHandler(user, pass string) ConnectHandler {
+	return func(natsConn *NatsConn, r *http.Request, wsConn *websocket.Conn) error {
+		if natsConn.Info.AuthRequired {
+			if err := writeConnect(natsConn, struct {
+				User    string `json:"user"`
+				Pass    string `json:"pass"`
+				Verbose bool   `json:"verbose"`
+			}{user, pass, false}); err != nil {
+				return err
+			}
+			if err := checkConnect(natsConn); err != nil {
+				return err
+			}
+		}
+		return natsConn.forwardInfo(wsConn)
+	}
+}
+
+// NKeyConnectHandler returns a ConnectHandler that authenticates to the NATS
+// server with an nkey: the nonce of the server INFO is signed with the seed,
+// like "SUA...", and sent along with the public key. The INFO is then
+// forwarded to the client. A missing nonce, an invalid seed or a rejection
+// are ErrAuthorization errors
+func NKeyConnectHandler(seed []byte) ConnectHandler {
+	return signedConnectHandler(seed, func(key *nkey, sig string) interface{} {
+		return struct {
+			NKey    string `json:"nkey"`
+			Sig     string `json:"sig"`
+			Verbose bool   `json:"verbose"`
+		}{key.public, sig, false}
+	})
+}
+
+// JWTConnectHandler returns a ConnectHandler that authenticates to the NATS
+// server with a user JWT, as issued in the decentralized auth mode: the
+// nonce of the server INFO is signed with the user seed, and sent along with
+// the JWT. The INFO is then forwarded to the client. A missing nonce, an
+// invalid seed or a rejection are ErrAuthorization errors
+func JWTConnectHandler(userJWT string, seed []byte) ConnectHandler {
+	return signedConnectHandler(seed, func(key *nkey, sig string) interface{} {
+		return struct {
+			JWT     string `json:"jwt"`
+			Sig     string `json:"sig"`
+			Verbose bool   `json:"verbose"`
+		}{userJWT, sig, false}
+	})
+}
+
+// signedConnectHandler returns a ConnectHandler signing the server nonce with
+// an nkey seed, and sending the CONNECT options built from the signature
+func signedConnectHandler(seed []byte, options func(key *nkey, sig string) interface{}) ConnectHandler {
+	key, err := parseSeed(seed)
+	return func(natsConn *NatsConn, r *http.Request, wsConn *websocket.Conn) error {
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrAuthorization, err)
+		}
+		if !natsConn.Info.SupportsNKeys() {
+			return fmt.Errorf("%w: %w", ErrAuthorization, ErrNoNonce)
+		}
+		sig := key.sign(natsConn.Info.Nonce)
+		if err := writeConnect(natsConn, options(key, sig)); err != nil {
+			return err
+		}
+		if err := checkConnect(natsConn); err != nil {
+			return err
+		}
+		return natsConn.forwardInfo(wsConn)
+	}
+}
+
+// managedConnectHandler is the ConnectHandler of the GatewayManagedConnect
+// mode. It sends the CONNECT built by Settings.ConnectBuilder, checks it,
+// then forwards the INFO to the client
+func (gw *Gateway) managedConnectHandler(natsConn *NatsConn, r *http.Request, wsConn *websocket.Conn) error {
+	options, err := gw.settings.ConnectBuilder(r, natsConn)
+	if err != nil {
+		return err
+	}
+	cmd := append([]byte("CONNECT "), bytes.TrimSpace(options)...)
+	cmd = append(cmd, '\r', '\n')
+	if err := natsConn.writeCommand(cmd); err != nil {
+		return err
+	}
+	if err := checkConnect(natsConn); err != nil {
+		return err
+	}
+	return natsConn.forwardInfo(wsConn)
+}
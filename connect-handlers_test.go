@@ -0,0 +1,259 @@
+package gw
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"gotest.tools/assert"
+)
+
+func TestTokenConnectHandler(t *testing.T) {
+	connect := make(chan string, 1)
+	server := newTestGateway(t, Settings{
+		ConnectHandler: TokenConnectHandler(`s3cr"t`),
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {\"auth_required\":true}\r\n"))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		connect <- line
+	})
+	wsConn := dialTestGateway(t, server)
+
+	assert.Equal(t, "CONNECT {\"auth_token\":\"s3cr\\\"t\"}\r\n", <-connect)
+	assert.Equal(t, "INFO {\"auth_required\":true}\r\n", readWSMessage(t, wsConn))
+}
+
+func TestUserPassConnectHandler(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		info      string
+		answer    string
+		connect   string
+		closeCode int
+	}{
+		{
+			name:    "auth not required",
+			info:    "INFO {}\r\n",
+			connect: "",
+		},
+		{
+			name:    "accepted",
+			info:    "INFO {\"auth_required\":true}\r\n",
+			answer:  "PONG\r\n",
+			connect: "CONNECT {\"user\":\"joe\",\"pass\":\"pa\\\"ss\",\"verbose\":false}\r\n",
+		},
+		{
+			name:      "rejected",
+			info:      "INFO {\"auth_required\":true}\r\n",
+			answer:    "-ERR 'Authorization Violation'\r\n",
+			connect:   "CONNECT {\"user\":\"joe\",\"pass\":\"pa\\\"ss\",\"verbose\":false}\r\n",
+			closeCode: websocket.ClosePolicyViolation,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			connect := make(chan string, 1)
+			server := newTestGateway(t, Settings{
+				ConnectHandler: UserPassConnectHandler("joe", `pa"ss`),
+			}, func(conn net.Conn) {
+				conn.Write([]byte(tt.info))
+				if tt.answer == "" {
+					connect <- ""
+					conn.Read(make([]byte, 1))
+					return
+				}
+				reader := bufio.NewReader(conn)
+				line, _ := reader.ReadString('\n')
+				connect <- line
+				reader.ReadString('\n') // PING
+				conn.Write([]byte(tt.answer))
+			})
+			wsConn := dialTestGateway(t, server)
+
+			assert.Equal(t, tt.connect, <-connect)
+			if tt.closeCode != 0 {
+				_, _, err := wsConn.ReadMessage()
+				assert.Assert(t, websocket.IsCloseError(err, tt.closeCode), err)
+			} else {
+				assert.Equal(t, tt.info, readWSMessage(t, wsConn))
+			}
+		})
+	}
+}
+
+func TestHeaderToConnectField(t *testing.T) {
+	connect := make(chan string, 1)
+	server := newTestGateway(t, Settings{
+		HeaderToConnectField: map[string]string{
+			"Authorization": "auth_token",
+			"X-User":        "user",
+		},
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		connect <- line
+	})
+	wsConn, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(server.URL, "http"),
+		http.Header{"Authorization": []string{`Bearer "x"`}})
+	assert.NilError(t, err)
+	defer wsConn.Close()
+
+	assert.Equal(t, "CONNECT {\"auth_token\":\"Bearer \\\"x\\\"\"}\r\n", <-connect)
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+}
+
+func TestConnectRewriter(t *testing.T) {
+	received := make(chan string, 10)
+	server := newTestGateway(t, Settings{
+		ConnectRewriter: func(raw []byte) ([]byte, error) {
+			var options map[string]interface{}
+			if err := json.Unmarshal(raw, &options); err != nil {
+				return nil, err
+			}
+			delete(options, "auth_token")
+			options["verbose"] = false
+			return json.Marshal(options)
+		},
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			received <- line
+		}
+	})
+	wsConn := dialTestGateway(t, server)
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+
+	assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage,
+		[]byte("CONNECT {\"verbose\":true,\"auth_token\":\"x\"}\r\nSUB foo 1\r\n")))
+	assert.Equal(t, "CONNECT {\"verbose\":false}\r\n", <-received)
+	assert.Equal(t, "SUB foo 1\r\n", <-received)
+
+	// the CONNECTs that are not the first command are rewritten too
+	assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage,
+		[]byte("PING\r\nCONNECT {\"auth_token\":\"evil\",\"verbose\":true}\r\n")))
+	assert.Equal(t, "PING\r\n", <-received)
+	assert.Equal(t, "CONNECT {\"verbose\":false}\r\n", <-received)
+	assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage,
+		[]byte("CONNECT {\"auth_token\":\"evil\"}\r\n")))
+	assert.Equal(t, "CONNECT {\"verbose\":false}\r\n", <-received)
+}
+
+func TestGatewayManagedConnect(t *testing.T) {
+	received := make(chan string, 10)
+	server := newTestGateway(t, Settings{
+		GatewayManagedConnect: true,
+		ConnectBuilder: func(r *http.Request, natsConn *NatsConn) ([]byte, error) {
+			return json.Marshal(map[string]string{"auth_token": r.URL.Query().Get("tenant")})
+		},
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {\"auth_required\":true}\r\n"))
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if line == "PING\r\n" {
+				conn.Write([]byte("PONG\r\n"))
+			}
+			received <- line
+		}
+	})
+	wsConn, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(server.URL, "http")+"?tenant=acme", nil)
+	assert.NilError(t, err)
+	defer wsConn.Close()
+
+	assert.Equal(t, "CONNECT {\"auth_token\":\"acme\"}\r\n", <-received)
+	assert.Equal(t, "PING\r\n", <-received)
+	assert.Equal(t, "INFO {\"auth_required\":true}\r\n", readWSMessage(t, wsConn))
+
+	// the client CONNECT is dropped
+	assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage,
+		[]byte("CONNECT {\"auth_token\":\"forged\"}\r\nSUB foo 1\r\n")))
+	assert.Equal(t, "SUB foo 1\r\n", <-received)
+	// and so are the ones sent after other commands
+	assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage,
+		[]byte("PING\r\nCONNECT {\"auth_token\":\"forged\"}\r\nSUB bar 2\r\n")))
+	assert.Equal(t, "PING\r\n", <-received)
+	assert.Equal(t, "SUB bar 2\r\n", <-received)
+	assert.Equal(t, "PONG\r\n", readWSMessage(t, wsConn))
+}
+
+func TestSignedConnectHandlers(t *testing.T) {
+	seed := encodeTestSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+	key, err := parseSeed(seed)
+	assert.NilError(t, err)
+	for _, tt := range []struct {
+		name      string
+		handler   ConnectHandler
+		info      string
+		answer    string
+		jwt       string
+		closeCode int
+	}{
+		{"nkey", NKeyConnectHandler(seed), "INFO {\"nonce\":\"n0nce\"}\r\n", "PONG\r\n", "", 0},
+		{"jwt", JWTConnectHandler("eyJ0.user.jwt", seed), "INFO {\"nonce\":\"n0nce\"}\r\n", "PONG\r\n", "eyJ0.user.jwt", 0},
+		{"rejected", NKeyConnectHandler(seed), "INFO {\"nonce\":\"n0nce\"}\r\n", "-ERR 'Authorization Violation'\r\n", "", websocket.ClosePolicyViolation},
+		{"jwt rejected", JWTConnectHandler("eyJ0.user.jwt", seed), "INFO {\"nonce\":\"n0nce\"}\r\n", "-ERR 'Authorization Violation'\r\n", "eyJ0.user.jwt", websocket.ClosePolicyViolation},
+		{"no nonce", JWTConnectHandler("eyJ0.user.jwt", seed), "INFO {}\r\n", "", "", websocket.ClosePolicyViolation},
+		{"invalid seed", NKeyConnectHandler([]byte("SUXX")), "INFO {\"nonce\":\"n0nce\"}\r\n", "", "", websocket.ClosePolicyViolation},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			connect := make(chan string, 1)
+			errs := make(chan error, 1)
+			server := newTestGateway(t, Settings{
+				ConnectHandler: tt.handler,
+				ErrorHandler:   func(err error) { errs <- err },
+			}, func(conn net.Conn) {
+				conn.Write([]byte(tt.info))
+				reader := bufio.NewReader(conn)
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				connect <- line
+				reader.ReadString('\n') // PING
+				conn.Write([]byte(tt.answer))
+				conn.Read(make([]byte, 1))
+			})
+			wsConn := dialTestGateway(t, server)
+
+			if tt.answer != "" {
+				var options struct {
+					NKey string `json:"nkey"`
+					JWT  string `json:"jwt"`
+					Sig  string `json:"sig"`
+				}
+				line := <-connect
+				assert.Assert(t, strings.HasPrefix(line, "CONNECT "), line)
+				assert.NilError(t, json.Unmarshal([]byte(line[len("CONNECT "):]), &options))
+				assert.Equal(t, tt.jwt, options.JWT)
+				if tt.jwt == "" {
+					assert.Equal(t, key.public, options.NKey)
+				}
+				verifyTestSig(t, key.public, "n0nce", options.Sig)
+			}
+			if tt.closeCode != 0 {
+				_, _, err := wsConn.ReadMessage()
+				assert.Assert(t, websocket.IsCloseError(err, tt.closeCode), "%v", err)
+				err = <-errs
+				assert.Assert(t, errors.Is(err, ErrAuthorization), "%v", err)
+			} else {
+				assert.Equal(t, tt.info, readWSMessage(t, wsConn))
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package gw
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"gotest.tools/assert"
+)
+
+// pipeListener is a net.Listener whose connections are in-memory pipes
+type pipeListener struct {
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// dial opens a connection to the listener
+func (l *pipeListener) dial(network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// fakeNatsServer is a minimal NATS server delivering the PUBs to the matching
+// SUBs of the same connection
+func fakeNatsServer(conn net.Conn) {
+	conn.Write([]byte("INFO {\"server_id\":\"fake\",\"max_payload\":1024}\r\n"))
+	reader := NewCommandsReader(conn)
+	subs := make(map[string]string)
+	for {
+		cmd, err := reader.NextCommand()
+		if err != nil {
+			return
+		}
+		op, args := splitCommand(cmd)
+		switch op {
+		case "CONNECT":
+			conn.Write([]byte("+OK\r\n"))
+		case "PING":
+			conn.Write([]byte("PONG\r\n"))
+		case "SUB":
+			subs[string(args[0])] = string(args[len(args)-1])
+		case "PUB":
+			sid, ok := subs[string(args[0])]
+			if !ok {
+				continue
+			}
+			line := cmd[:strings.Index(string(cmd), "\r\n")+2]
+			payload := cmd[len(line):]
+			fmt.Fprintf(conn, "MSG %s %s %d\r\n%s", args[0], sid, len(payload)-2, payload)
+		}
+	}
+}
+
+func TestEndToEnd(t *testing.T) {
+	gateway := NewGateway(Settings{
+		NatsAddr:     "nats:4222",
+		ErrorHandler: func(error) {},
+		Logger:       &testLogger{},
+		Dialer: func(network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				fakeNatsServer(server)
+			}()
+			return client, nil
+		},
+	})
+	listener := newPipeListener()
+	server := &http.Server{Handler: http.HandlerFunc(gateway.Handler)}
+	go server.Serve(listener)
+	defer server.Close()
+
+	dialer := websocket.Dialer{NetDial: listener.dial}
+	wsConn, _, err := dialer.Dial("ws://gateway/nats", nil)
+	assert.NilError(t, err)
+	defer wsConn.Close()
+
+	assert.Equal(t,
+		"INFO {\"server_id\":\"fake\",\"max_payload\":1024}\r\n",
+		readWSMessage(t, wsConn))
+	for _, cmd := range []string{
+		"CONNECT {\"verbose\":true}\r\n",
+		"SUB greetings 1\r\n",
+		"PUB greetings 5\r\nhello\r\n",
+		"PING\r\n",
+	} {
+		assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte(cmd)))
+	}
+	assert.Equal(t, "+OK\r\n", readWSMessage(t, wsConn))
+	assert.Equal(t, "MSG greetings 1 5\r\nhello\r\n", readWSMessage(t, wsConn))
+	assert.Equal(t, "PONG\r\n", readWSMessage(t, wsConn))
+
+	// the messages also go through, the other way round, when split
+	// across several websocket messages
+	reader := bufio.NewReader(strings.NewReader("PUB greetings 3\r\nbye\r\n"))
+	for {
+		chunk := make([]byte, 7)
+		n, _ := reader.Read(chunk)
+		if n == 0 {
+			break
+		}
+		assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, chunk[:n]))
+	}
+	assert.Equal(t, "MSG greetings 1 3\r\nbye\r\n", readWSMessage(t, wsConn))
+}
@@ -0,0 +1,175 @@
+package gw
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrIdleTimeout is reported when the NATS server stays silent for longer
+// than Settings.IdleTimeout
+var ErrIdleTimeout = errors.New("NATS connection idle timeout")
+
+// ErrWSPongTimeout is reported when a client does not answer a websocket
+// ping within Settings.WSPongTimeout
+var ErrWSPongTimeout = errors.New("Websocket pong timeout")
+
+// ErrAuthorization is returned by the ConnectHandler helpers when the NATS
+// server rejects the gateway CONNECT
+var ErrAuthorization = errors.New("NATS authorization failed")
+
+// ErrInvalidSeed is returned when an nkey seed cannot be decoded
+var ErrInvalidSeed = errors.New("Invalid nkey seed")
+
+// ErrNoNonce is returned by the nkey and JWT ConnectHandler helpers when the
+// NATS server INFO has no nonce to sign
+var ErrNoNonce = errors.New("No nonce in the NATS server INFO")
+
+// ErrInvalidInfo is returned when the first command sent by the NATS server
+// is not a valid INFO
+var ErrInvalidInfo = errors.New("Invalid 'INFO'")
+
+// ErrInfoTimeout is returned when the NATS server does not send its INFO
+// within Settings.InfoReadTimeout
+var ErrInfoTimeout = errors.New("NATS INFO read timeout")
+
+// ErrInfoTooLarge is returned when the INFO sent by the NATS server is bigger
+// than Settings.MaxInfoSize
+var ErrInfoTooLarge = errors.New("NATS INFO too large")
+
+// ErrNatsDial wraps the errors dialing the NATS server
+var ErrNatsDial = errors.New("NATS dial failed")
+
+// ErrTLSHandshake wraps the errors of the TLS handshake with the NATS server
+var ErrTLSHandshake = errors.New("nats tls handshake")
+
+// ErrUpgrade wraps the errors upgrading a request to a websocket
+var ErrUpgrade = errors.New("websocket upgrade failed")
+
+// ErrHeadersNotSupported is reported when a client sends a HPUB to a NATS
+// server that does not advertise the headers support
+var ErrHeadersNotSupported = errors.New("Headers not supported by the NATS server")
+
+// ErrMissingCRLF is returned when the payload of a MSG, PUB, HMSG or HPUB is
+// not followed by a '\r\n', its declared size not matching the actual one.
+// The clients get an 'Invalid Publish' error
+var ErrMissingCRLF = errors.New("missing trailing CRLF")
+
+// ErrMaxControlLine is reported when a client sends a control line longer
+// than Settings.MaxControlLine
+var ErrMaxControlLine = errors.New("Maximum control line exceeded")
+
+// ErrWSMessageTooLarge is reported when a client sends a websocket message
+// bigger than Settings.MaxWSMessageSize
+var ErrWSMessageTooLarge = errors.New("Websocket message too large")
+
+// ErrMaxPayload matches the *MaxPayloadError errors with errors.Is
+var ErrMaxPayload = errors.New("Maximum payload violation")
+
+// MaxPayloadError is reported when a client publishes a message bigger than
+// the max_payload advertised by the NATS server
+type MaxPayloadError struct {
+	Size       int64
+	MaxPayload int64
+}
+
+func (e *MaxPayloadError) Error() string {
+	return fmt.Sprintf("%s: %d > %d", ErrMaxPayload, e.Size, e.MaxPayload)
+}
+
+// Is makes a *MaxPayloadError match ErrMaxPayload
+func (e *MaxPayloadError) Is(target error) bool {
+	return target == ErrMaxPayload
+}
+
+// CommandTooLargeError is reported when the NATS server sends a command
+// bigger than Settings.MaxCommandSize. Size is the size known when the
+// command was rejected, which may be less than its whole size
+type CommandTooLargeError struct {
+	Size           int
+	MaxCommandSize int
+}
+
+func (e *CommandTooLargeError) Error() string {
+	return fmt.Sprintf("NATS command too large: %d > %d", e.Size, e.MaxCommandSize)
+}
+
+// PermissionError is reported when AuthorizeSubject, or the ReadOnly or
+// WriteOnly mode, rejects a client command
+type PermissionError struct {
+	Op      string
+	Subject string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("Permissions violation: %s %s", e.Op, e.Subject)
+}
+
+// natsErr returns the -ERR command sent back to the client
+func (e *PermissionError) natsErr() string {
+	kind := "Subscription to"
+	if e.Op == "PUB" || e.Op == "HPUB" {
+		kind = "Publish to"
+	}
+	return fmt.Sprintf("-ERR 'Permissions Violation for %s \"%s\"'\r\n", kind, e.Subject)
+}
+
+// ServerError is reported when the NATS server sends a fatal -ERR, after
+// which it closes the connection
+type ServerError struct {
+	Reason string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("NATS server error: %s", e.Reason)
+}
+
+// ConnError is passed to the ErrorHandler for the errors of a websocket
+// session, carrying the session correlation id (see NatsConn.ID). It unwraps
+// to the actual error
+type ConnError struct {
+	ID  string
+	Err error
+}
+
+func (e *ConnError) Error() string {
+	return fmt.Sprintf("[%s] %s", e.ID, e.Err)
+}
+
+func (e *ConnError) Unwrap() error {
+	return e.Err
+}
+
+// serverErrCloseCode returns the websocket close code matching a NATS -ERR
+// reason, and whether the error is fatal to the connection
+func serverErrCloseCode(reason string) (int, bool) {
+	lower := strings.ToLower(reason)
+	switch {
+	case strings.HasPrefix(lower, "permissions violation"),
+		strings.HasPrefix(lower, "invalid subject"),
+		strings.HasPrefix(lower, "invalid publish subject"),
+		strings.HasPrefix(lower, "invalid queue name"):
+		// the connection stays open
+		return 0, false
+	case strings.Contains(lower, "authorization"),
+		strings.Contains(lower, "authentication"):
+		return websocket.ClosePolicyViolation, true
+	case strings.HasPrefix(lower, "maximum payload"):
+		return websocket.CloseMessageTooBig, true
+	default:
+		return websocket.CloseInternalServerErr, true
+	}
+}
+
+// maxCloseReasonLen is the maximum length of a websocket close reason: a
+// control frame payload is at most 125 bytes, 2 of which hold the code
+const maxCloseReasonLen = 123
+
+func closeReason(reason string) string {
+	if len(reason) > maxCloseReasonLen {
+		return reason[:maxCloseReasonLen]
+	}
+	return reason
+}
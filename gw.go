@@ -2,11 +2,18 @@ package gw
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -14,22 +21,387 @@ import (
 // ErrorHandler is used in Settings for handling errors
 type ErrorHandler func(error)
 
+// DisconnectHandler is used in Settings for handling the normal termination
+// of a connection, either closed by the websocket client or by the NATS
+// server
+type DisconnectHandler func(error)
+
 // ConnectHandler is used in Settings for handling the initial CONNECT of
 // a nats connection
 type ConnectHandler func(*NatsConn, *http.Request, *websocket.Conn) error
 
+// Dialer is used in Settings for opening the connection to the NATS server
+type Dialer func(network, addr string) (net.Conn, error)
+
 // NatsServerInfo is the information returned by the INFO nats message
 type NatsServerInfo string
 
 // Settings configures a Gateway
 type Settings struct {
-	NatsAddr       string
-	EnableTLS      bool
-	TLSConfig      *tls.Config
-	ConnectHandler ConnectHandler
-	ErrorHandler   ErrorHandler
-	WSUpgrader     *websocket.Upgrader
-	Trace          bool
+	// NatsAddr is the address of the NATS server: a host:port, or a
+	// nats:// or tls:// URL as configured for the NATS clients, the port
+	// defaulting to 4222. A tls:// URL, in NatsAddr or NatsAddrs, implies
+	// EnableTLS. With the "unix" NatsNetwork, it is the socket path
+	NatsAddr  string
+	EnableTLS bool
+	// NatsTLSConfig configures the TLS connection to the NATS server, see
+	// EnableTLS. The websocket side is configured by ListenTLSConfig. By
+	// default, the server certificate is verified against the system roots.
+	// Unless set, the ServerName is the host of the NATS address dialed, but
+	// for an IP address. It must be set over a unix socket, unless
+	// NatsTLSInsecure is set, as a socket path cannot verify a certificate
+	NatsTLSConfig *tls.Config
+	// NatsTLSInsecure disables the verification of the NATS server
+	// certificate. It should only be used for testing
+	NatsTLSInsecure bool
+	// TLSConfig is the former name of NatsTLSConfig.
+	//
+	// Deprecated: use NatsTLSConfig
+	TLSConfig *tls.Config
+	// NatsClientCert and NatsClientKey are the paths of a PEM certificate
+	// and key presented to the NATS server during the TLS handshake, in
+	// addition to the certificates of NatsTLSConfig. NewGatewayWithValidation
+	// fails if they cannot be loaded, NewGateway fails the connections
+	NatsClientCert string
+	NatsClientKey  string
+	// ListenTLSConfig configures the servers started by ListenAndServeTLS,
+	// independently of NatsTLSConfig
+	ListenTLSConfig *tls.Config
+	ConnectHandler  ConnectHandler
+	ErrorHandler    ErrorHandler
+	WSUpgrader      *websocket.Upgrader
+	// WSReadBufferSize and WSWriteBufferSize, if set, are the sizes of the
+	// websocket connection buffers, overriding the ones of WSUpgrader. They
+	// default to 1024 bytes. Bigger buffers save syscalls on the big
+	// messages, at the expense of the memory of each connection
+	WSReadBufferSize  int
+	WSWriteBufferSize int
+	// WSReuseServerBuffers makes the websocket connections reuse the
+	// buffers the HTTP server allocated for the upgrade request (4KB with
+	// net/http) instead of allocating their own
+	WSReuseServerBuffers bool
+	Trace                bool
+	// OnFrame, if set, is called with each command or message forwarded,
+	// in the dir direction, including the INFO and the commands sent by
+	// the gateway itself. It is the programmatic counterpart of Trace, for
+	// example for keeping the last frames in a ring buffer. The data is
+	// only valid during the call and must be copied to be retained. It is
+	// called in the forwarding path, and thus slows it down
+	OnFrame func(dir string, data []byte)
+	// Logger receives the trace logs, and the errors if ErrorHandler is
+	// not set. Defaults to a WriterLogger on os.Stderr
+	Logger Logger
+	// NatsAddrs are additional nats server addresses. The connection is
+	// attempted on each address until one succeeds, in an order given by
+	// BalanceStrategy
+	NatsAddrs       []string
+	BalanceStrategy BalanceStrategy
+	// IgnoreConnectURLs disables the addition of the cluster addresses
+	// advertised by the servers (INFO connect_urls) to the NatsAddrs
+	IgnoreConnectURLs bool
+	// NatsNetwork is the network NatsAddr is dialed on: "tcp" (default) or
+	// "unix". EnableTLS is allowed over a unix socket, although unusual,
+	// with the ServerName of NatsTLSConfig set
+	NatsNetwork string
+	// Dialer, if set, is used instead of net.Dial to connect to NatsAddr
+	Dialer Dialer
+	// DialTimeout bounds the time spent connecting to NatsAddr. Zero means
+	// no timeout. A custom Dialer outliving it has its connection closed
+	// once it returns
+	DialTimeout time.Duration
+	// InfoReadTimeout bounds the wait for the INFO the NATS server sends
+	// on connect, once the connection is established. Zero means 5
+	// seconds
+	InfoReadTimeout time.Duration
+	// MaxInfoSize bounds the INFO the NATS server sends on connect, read
+	// before the server is authenticated. Zero means 1MB
+	MaxInfoSize int
+	// WriteTimeout bounds the time a websocket write may take. A client
+	// not reading its messages in time gets disconnected. Zero means no
+	// timeout
+	WriteTimeout time.Duration
+	// IdleTimeout is the maximum time to wait for a command from the NATS
+	// server before closing the connection with ErrIdleTimeout. Zero means
+	// no timeout
+	IdleTimeout time.Duration
+	// HeaderToConnectField maps HTTP request header names to NATS CONNECT
+	// json keys. When set, the default ConnectHandler sends a CONNECT built
+	// from the headers found in the request, the missing ones being skipped
+	HeaderToConnectField map[string]string
+	// SanitizeInfo makes the gateway forward only the max_payload, proto,
+	// headers and nonce fields of the server INFO to the clients, instead
+	// of the raw INFO disclosing the server id, version and cluster
+	// addresses
+	SanitizeInfo bool
+	// HandlePing makes the gateway answer the NATS server PINGs itself
+	// instead of forwarding them to the client
+	HandlePing bool
+	// RespondToWSPing installs a websocket ping handler that answers the
+	// client pings and also resets the NATS IdleTimeout, so that a client
+	// doing websocket keepalive keeps its NATS connection alive
+	RespondToWSPing bool
+	// WSPingInterval makes the gateway send a websocket ping to the
+	// clients after each WSPingInterval of keepalive, so that the
+	// intermediaries do not close the idle connections. A client not
+	// answering a ping with a pong within WSPongTimeout is disconnected
+	// with ErrWSPongTimeout
+	WSPingInterval time.Duration
+	// WSPongTimeout defaults to WSPingInterval
+	WSPongTimeout time.Duration
+	// CopyBufferSize is the size of the buffers used for copying the
+	// websocket messages to NATS. The buffers are pooled and shared by all
+	// the connections, a bigger message is read in a buffer of its own.
+	// It has no effect when the gateway parses the client commands, which
+	// it does as soon as the NATS server advertises a max_payload, as the
+	// real servers do, or does not support the headers, or an inbound
+	// policy is set (AuthorizeSubject, ReadOnly, MaxMessagesPerSecond, a
+	// CONNECT hook...): the messages are only copied as is to the servers
+	// supporting the headers without a max_payload. Defaults to 32KB
+	CopyBufferSize int
+	// ReadBufferSize is the size of the buffer used for reading the NATS
+	// connection. Defaults to 4KB. See NewCommandsReaderSize for tuning it
+	ReadBufferSize int
+	// MaxCommandSize is the maximum size of a command sent by the NATS
+	// server, above which the connection is closed. Defaults to 64MB, the
+	// highest max_payload a NATS server accepts, plus room for the control
+	// line. It also bounds the payloads sent by the clients when the server
+	// does not advertise a max_payload
+	MaxCommandSize int
+	// MaxControlLine is the maximum size of the control lines (the commands
+	// without their payload) sent by the clients, when the gateway parses
+	// them, and the size of the buffer reading them. Defaults to 4KB, like
+	// the NATS server
+	MaxControlLine int
+	// MaxWSMessageSize is the maximum size of a websocket message sent by a
+	// client. A bigger message closes the connection with
+	// ErrWSMessageTooLarge, the client receiving a 1009 (message too big)
+	// close. Defaults to the NATS max_payload plus MaxControlLine and its
+	// CRLF, or to MaxCommandSize if the server has no max_payload
+	MaxWSMessageSize int64
+	// SendProxyProtocol, if set, makes the gateway send a PROXY protocol
+	// header carrying the websocket client address as the first bytes of
+	// the NATS connections, so that the NATS side sees the real client IPs
+	SendProxyProtocol bool
+	// ProxyProtocolVersion is the version of the PROXY protocol header, 1
+	// (the default, human readable) or 2 (binary)
+	ProxyProtocolVersion int
+	// ResponseHeader, if set, returns the headers added to the handshake
+	// response of a request, for example a cookie or a correlation id.
+	// Unless Subprotocols is set, a Sec-Websocket-Protocol header sets the
+	// negotiated subprotocol
+	ResponseHeader func(*http.Request) http.Header
+	// PreUpgrade, if set, is called with each websocket request before it
+	// is upgraded and before NATS is connected, for example for checking an
+	// auth cookie or validating the path. Returning false rejects the
+	// request, the hook having written the response itself. See
+	// SetConnValue for passing values to the following hooks
+	PreUpgrade func(w http.ResponseWriter, r *http.Request) bool
+	// DrainTimeout, if > 0, bounds the wait for the workers of a closed
+	// connection. A worker still running afterwards is abandoned with a
+	// warning, so that the handler returns anyway
+	DrainTimeout time.Duration
+	// EnableCompression makes the gateway negotiate the permessage-deflate
+	// extension with the websocket clients. The compression only applies
+	// to the websocket layer, the NATS commands being unchanged
+	EnableCompression bool
+	// CompressionLevel is the flate compression level, see
+	// websocket.Conn.SetCompressionLevel. Defaults to
+	// flate.BestSpeed
+	CompressionLevel int
+	// CompressionMinSize is the size of the smallest message sent
+	// compressed, the smaller ones not being worth it. Defaults to 0,
+	// all the messages being compressed
+	CompressionMinSize int
+	// BatchWindow, if > 0, makes the gateway coalesce the NATS commands
+	// received within this duration into a single websocket message, which
+	// the client must split back into commands. It trades some latency for
+	// less framing overhead under high message rates
+	BatchWindow time.Duration
+	// BatchMaxBytes is the maximum size of a batched websocket message, a
+	// bigger command being sent alone. Defaults to 64KB
+	BatchMaxBytes int
+	// ForwardPartial makes the gateway forward the bytes received from NATS
+	// to the websocket as soon as they are read, instead of one command per
+	// message. It lowers the latency for the clients doing their own
+	// parsing, at the cost of the features that need whole commands:
+	// HandlePing, BatchWindow, OutboundQueueSize, OutboundFilter,
+	// SubjectMapper, SubjectMetrics, MaxCommandSize and the websocket close
+	// on fatal server errors are ignored
+	ForwardPartial bool
+	// ConnectRetries is the number of times connecting to NATS is retried
+	// before giving up, waiting ConnectBackoff before the first retry and
+	// doubling the wait each time. When it is set, NATS is connected before
+	// upgrading the websocket, so that a failure is answered with a 503
+	ConnectRetries int
+	// ConnectBackoff defaults to 100ms
+	ConnectBackoff time.Duration
+	// BreakerThreshold enables a circuit breaker: after that many
+	// consecutive failures connecting to NATS, the websocket requests are
+	// answered with a 503 without connecting it, for BreakerCooldown. A
+	// single request is then let through per BreakerCooldown until the
+	// connection succeeds again. See Gateway.BreakerState
+	BreakerThreshold int
+	// BreakerCooldown defaults to 10s
+	BreakerCooldown time.Duration
+	// ReuseConnections makes the gateway pool the NATS connections of the
+	// websocket sessions ended by the clients, and hand them to the
+	// following sessions instead of opening new ones. The subscriptions of
+	// a session are removed before its connection is pooled.
+	//
+	// A reused connection keeps the authentication of its first session:
+	// the ConnectHandler and the client CONNECT of the following sessions
+	// are sent again, but the NATS server may not apply them. It is thus
+	// only suited to gateways whose sessions all share the same credentials,
+	// for example with TokenConnectHandler
+	ReuseConnections bool
+	// PoolSize is the maximum number of idle connections kept by the pool.
+	// Defaults to 16
+	PoolSize int
+	// PoolIdleTimeout is how long an idle connection is kept in the pool.
+	// Defaults to 30s
+	PoolIdleTimeout time.Duration
+	// MaxMessagesPerSecond, if > 0, limits the rate of the PUB and HPUB
+	// sent by each client, with bursts of up to MessagesBurst messages
+	// (defaults to MaxMessagesPerSecond). The messages over the limit are
+	// delayed or, if DropThrottled is set, dropped and answered with a
+	// -ERR
+	MaxMessagesPerSecond float64
+	MessagesBurst        int
+	DropThrottled        bool
+	// MaxBytesPerSecond, if > 0, limits the bandwidth used by each client
+	// towards NATS, with bursts of up to BytesBurst bytes (defaults to
+	// MaxBytesPerSecond). The writes over the limit are delayed before
+	// being started, so that the wait does not count in their duration
+	MaxBytesPerSecond int
+	BytesBurst        int
+	// OutboundQueueSize, if > 0, is the size of a queue decoupling the NATS
+	// reads from the websocket writes. When the queue is full, the NATS
+	// reads are blocked, unless OutboundDropOldest is set in which case the
+	// oldest queued command is dropped
+	OutboundQueueSize  int
+	OutboundDropOldest bool
+	// MaxConnections, if > 0, limits the number of simultaneous websocket
+	// connections. The requests beyond the limit get a 503 response
+	MaxConnections int
+	// CheckOrigin, if set, is used by the websocket upgrader to check the
+	// request origin, see AllowedOrigins. When neither CheckOrigin nor
+	// WSUpgrader.CheckOrigin is set, all the origins are accepted
+	CheckOrigin func(*http.Request) bool
+	// Subprotocols are the websocket subprotocols accepted by the gateway, in
+	// order of preference. The one negotiated with the client is available
+	// on NatsConn.Subprotocol
+	Subprotocols []string
+	// SubprotocolModes maps subprotocols to the mode they imply, and
+	// DefaultMode is the mode used when neither the 'mode' query parameter
+	// nor the subprotocol tell it. See Gateway.connMode for the precedence
+	SubprotocolModes map[string]Mode
+	DefaultMode      Mode
+	// RateLimiter, if set, is consulted with the client IP before upgrading
+	// a request. The throttled requests get a 429 response
+	RateLimiter RateLimiter
+	// TrustForwardedFor makes the client IP be read from the
+	// X-Forwarded-For header, when running behind a proxy. Prefer
+	// TrustedProxies, which ignores the headers of the untrusted peers
+	TrustForwardedFor bool
+	// TrustedProxies is a list of CIDRs (or single IPs) of the proxies the
+	// gateway runs behind. When the direct peer of a request is one of them,
+	// the client IP is read from the X-Forwarded-For or X-Real-IP headers.
+	// It takes precedence over TrustForwardedFor
+	TrustedProxies []string
+	// CloseMessageFunc, if set, maps the error tearing down a connection to
+	// the close message sent to the websocket client, no message being sent
+	// if code is 0. By default, the normal disconnections are closed with
+	// 1000, the ErrAuthorization errors with 1008 and the other errors with
+	// 1011 "internal error". It is not used when the gateway already sent a
+	// more specific close message, for example when the NATS connection is
+	// closed or during a shutdown
+	CloseMessageFunc func(err error) (code int, text string)
+	// ConnectRewriter, if set, is called with the json options of the
+	// CONNECT commands sent by the client, and returns the options actually
+	// sent to the NATS server. Returning an error closes the connection
+	ConnectRewriter func(raw []byte) ([]byte, error)
+	// OnClientConnect, if set, is called with the json options of each
+	// CONNECT sent by the client, wherever it is in the stream, before it is
+	// rewritten, forwarded or dropped. The options of the first one are also
+	// kept in NatsConn.ClientConnect. Returning an error closes the
+	// connection, with a policy violation if it wraps ErrAuthorization
+	OnClientConnect func(req *http.Request, options []byte) error
+	// GatewayManagedConnect makes the gateway own the authentication: the
+	// CONNECT built by ConnectBuilder is sent to the NATS server right
+	// after its INFO, and checked with a PING, before the INFO is
+	// forwarded to the client. The CONNECT commands sent by the client are
+	// then dropped. It replaces the ConnectHandler
+	GatewayManagedConnect bool
+	// ConnectBuilder returns the json options of the CONNECT sent in the
+	// GatewayManagedConnect mode
+	ConnectBuilder func(r *http.Request, natsConn *NatsConn) ([]byte, error)
+	// AuthorizeSubject, if set, is called for each PUB, HPUB, SUB and UNSUB
+	// sent by the client, with the operation and the subject. When it
+	// returns false the command is dropped and a 'Permissions Violation'
+	// error is sent back to the client. The malformed commands are rejected
+	// and close the connection
+	AuthorizeSubject func(req *http.Request, op string, subject string) bool
+	// ReadOnly makes the gateway subscribe-only: the PUB and HPUB sent by
+	// the clients are dropped with a 'Permissions Violation' error
+	ReadOnly bool
+	// WriteOnly makes the gateway publish-only: the SUB and UNSUB sent by
+	// the clients are dropped with a 'Permissions Violation' error
+	WriteOnly bool
+	// OutboundFilter, if set, is called with each command received from the
+	// NATS server before it is forwarded to the websocket. It returns the
+	// command actually forwarded, or false to drop it
+	OutboundFilter func(cmd []byte) ([]byte, bool)
+	// SubjectMapper, if set, maps the subjects of the PUB, HPUB and SUB
+	// sent by the clients, after AuthorizeSubject, and the subjects of the
+	// MSG and HMSG sent back, before OutboundFilter. The reply subjects are
+	// mapped too
+	SubjectMapper SubjectMapper
+	// OnDisconnect, if set, is called instead of ErrorHandler when a
+	// connection terminates normally (websocket close, NATS EOF or
+	// cancellation of the request context)
+	OnDisconnect DisconnectHandler
+	// Metrics, if set, collects the gateway activity. Gateway.ServeMux
+	// serves them if they are a http.Handler
+	Metrics Metrics
+	// SubjectMetrics, if set, is called with the direction and the subject
+	// of each PUB, HPUB and SUB forwarded to NATS, and of each MSG and HMSG
+	// forwarded to the client. The subjects are the client ones, before
+	// the SubjectMapper and after the OutboundFilter. It is meant for
+	// counting the traffic per subject: as the subjects are often unique,
+	// like the reply inboxes, they should be bucketed, for example on
+	// their first tokens, before being used as metric labels
+	SubjectMetrics func(dir, subject string)
+	// OnConnClose, if set, is called with the connection statistics when a
+	// websocket <-> NATS pair is torn down
+	OnConnClose func(*ConnStats)
+	// OnConnect, if set, is called when a websocket <-> NATS pair is
+	// established, for observability purposes. See NatsConn.TLSVersion and
+	// NatsConn.TLSCipherSuite for the encryption of the NATS connection, and
+	// NatsConn.Compressed for the websocket compression
+	OnConnect func(*http.Request, *NatsConn)
+	// OnClose, if set, is called when a websocket <-> NATS pair ends, with
+	// the error that terminated it, or nil on a normal disconnection. See
+	// NatsConn.ClientCloseCode for the close code of the client. The
+	// NatsConn must not be used once OnClose returns, as it may be reused
+	OnClose func(*http.Request, *NatsConn, error)
+}
+
+// ConnStats holds the statistics of a websocket <-> NATS connection pair.
+// The counters are updated atomically and can be read at any time
+type ConnStats struct {
+	BytesNatsToWS atomic.Int64
+	BytesWSToNats atomic.Int64
+	// DroppedNatsToWS counts the commands dropped because the outbound
+	// queue was full
+	DroppedNatsToWS atomic.Int64
+	// AutoPongs counts the NATS PINGs answered by the gateway
+	AutoPongs atomic.Int64
+	// ThrottledWSToNats counts the client messages delayed or dropped by
+	// Settings.MaxMessagesPerSecond
+	ThrottledWSToNats atomic.Int64
+	// BytesQuota is the number of bytes the client can currently send
+	// without being paced by Settings.MaxBytesPerSecond, if set
+	BytesQuota atomic.Int64
 }
 
 // Gateway is a HTTP handler that acts as a websocket gateway to a NATS server
@@ -37,8 +409,184 @@ type Gateway struct {
 	settings      Settings
 	onError       ErrorHandler
 	handleConnect ConnectHandler
+	metrics       Metrics
+	logger        Logger
+
+	originWarning sync.Once
+
+	// copyBuffers holds the *[]byte buffers used for copying the websocket
+	// messages to NATS
+	copyBuffers sync.Pool
+
+	// addrCounter is used by the RoundRobin BalanceStrategy
+	addrCounter atomic.Uint64
+
+	// connSem is nil if the number of connections is not limited
+	connSem chan struct{}
+
+	// trustedProxies is the parsed Settings.TrustedProxies
+	trustedProxies []*net.IPNet
+
+	// natsTLSConfig is the TLS configuration of the NATS connections, or
+	// natsTLSErr the error building it
+	natsTLSConfig *tls.Config
+	natsTLSErr    error
+
+	// pool is nil unless Settings.ReuseConnections is set
+	pool *ConnPool
+	// breaker is nil unless Settings.BreakerThreshold is set
+	breaker *circuitBreaker
+
+	mu              sync.Mutex
+	discoveredAddrs []string
+	conns           map[*connPair]struct{}
+	connsWg         sync.WaitGroup
+	shuttingDown    bool
+	// servers are the servers started by ListenAndServe
+	servers []*http.Server
 }
 
+// connPair is a live websocket <-> NATS connection handled by the Gateway
+type connPair struct {
+	request *http.Request
+	// id is the correlation id of the connection
+	id          string
+	logger      Logger
+	wsConn      *safeConn
+	natsConn    *NatsConn
+	stats       ConnStats
+	idleTimeout time.Duration
+	// errOnce makes sure only the first error of the pair is reported, the
+	// other worker error being a mere consequence of the teardown
+	errOnce sync.Once
+	// err is the first error of the pair
+	err error
+	// closed is set, and done closed, once the gateway closes the pair
+	closed atomic.Bool
+	done   chan struct{}
+	// messages is nil unless Settings.MaxMessagesPerSecond is set. It is
+	// only used by the websocket to NATS worker
+	messages *tokenBucket
+	// bytes is nil unless Settings.MaxBytesPerSecond is set. It is only
+	// used by the websocket to NATS worker
+	bytes *tokenBucket
+	// subs holds the subscription ids of the client when its NATS
+	// connection may be reused, nil otherwise
+	subs map[string]struct{}
+}
+
+// resetIdleDeadline pushes back the read deadline of the NATS connection
+func (p *connPair) resetIdleDeadline() {
+	if p.idleTimeout > 0 {
+		p.natsConn.Conn.SetReadDeadline(time.Now().Add(p.idleTimeout))
+	}
+}
+
+// handleWSPing answers a websocket ping and keeps the NATS connection alive
+func (p *connPair) handleWSPing(data string) error {
+	p.resetIdleDeadline()
+	err := p.wsConn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	if err == websocket.ErrCloseSent {
+		return nil
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return nil
+	}
+	return err
+}
+
+// release closes the websocket and interrupts the NATS reads, without
+// closing the NATS connection so that it can be reused
+func (p *connPair) release() {
+	p.markClosed()
+	p.wsConn.Close()
+	p.natsConn.Conn.SetReadDeadline(time.Now())
+}
+
+// close forcibly closes both sides of the pair
+func (p *connPair) close() {
+	p.markClosed()
+	p.wsConn.Close()
+	p.natsConn.Close()
+}
+
+// keepalive pings the websocket client every interval until the pair is
+// closed. A pong not received on pongs within timeout of a ping fails the
+// pair with ErrWSPongTimeout
+func (gw *Gateway) keepalive(pair *connPair, pongs <-chan struct{}, interval, timeout time.Duration) {
+	for pair.wait(interval) {
+		err := pair.wsConn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout))
+		if err != nil {
+			// the workers see the broken connection too
+			return
+		}
+		timer := time.NewTimer(timeout)
+		select {
+		case <-pongs:
+			timer.Stop()
+		case <-pair.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+			gw.connError(pair, ErrWSPongTimeout)
+			// unblocks the websocket reader, the connection being kept
+			// for the close message
+			pair.wsConn.SetReadDeadline(time.Now())
+			return
+		}
+	}
+}
+
+// wait waits for d, and returns false if the pair is closed meanwhile
+func (p *connPair) wait(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+// paceBytes applies Settings.MaxBytesPerSecond to n bytes about to be
+// written to NATS, and returns false if the pair is closed meanwhile
+func (p *connPair) paceBytes(n int) bool {
+	wait := p.bytes.reserve(time.Now(), float64(n))
+	p.stats.BytesQuota.Store(int64(math.Max(0, p.bytes.tokens)))
+	return p.wait(wait)
+}
+
+func (p *connPair) markClosed() {
+	if p.closed.CompareAndSwap(false, true) {
+		close(p.done)
+	}
+}
+
+// defaultCopyBufferSize is the default Settings.CopyBufferSize
+const defaultCopyBufferSize = 32 * 1024
+
+// defaultConnectBackoff is the default Settings.ConnectBackoff
+const defaultConnectBackoff = 100 * time.Millisecond
+
+// defaultBatchMaxBytes is the default Settings.BatchMaxBytes
+const defaultBatchMaxBytes = 64 * 1024
+
+// defaultInfoReadTimeout is the default Settings.InfoReadTimeout
+const defaultInfoReadTimeout = 5 * time.Second
+
+// defaultMaxInfoSize is the default Settings.MaxInfoSize
+const defaultMaxInfoSize = 1024 * 1024
+
+// defaultMaxControlLine is the default Settings.MaxControlLine
+const defaultMaxControlLine = 4096
+
+// defaultMaxCommandSize is the default Settings.MaxCommandSize
+const defaultMaxCommandSize = 64*1024*1024 + 4*1024
+
 var defaultUpgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -49,204 +597,1510 @@ type NatsConn struct {
 	Conn       net.Conn
 	CmdReader  CommandsReader
 	ServerInfo NatsServerInfo
+	// Info is the parsed ServerInfo
+	Info ServerInfo
+	// ID is the correlation id of the websocket session using the
+	// connection, which prefixes its traces and is carried by its errors
+	ID string
+	// Subprotocol is the websocket subprotocol negotiated with the client
+	Subprotocol string
+	// RemoteAddr is the address of the NATS server
+	RemoteAddr net.Addr
+	// TLSState is the state of the TLS connection to the NATS server, nil
+	// if the connection is not encrypted. Its VerifiedChains are the
+	// verified certificate chains of the server, for auditing
+	TLSState *tls.ConnectionState
+	// ClientIP is the IP of the websocket client, as resolved by
+	// Gateway.ClientIP
+	ClientIP string
+	// Compressed tells if the permessage-deflate compression was
+	// negotiated with the websocket client, see Settings.EnableCompression
+	Compressed bool
+	// ClientConnect is the json options of the first CONNECT sent by the
+	// client, as received. It is set by the websocket reader when the
+	// client commands are inspected, which OnClientConnect, ConnectRewriter
+	// and GatewayManagedConnect guarantee, and may be read by the hooks
+	// called after, like OnClose
+	ClientConnect []byte
+	// ClientCloseCode and ClientCloseText are the websocket close code and
+	// text of the client, when it closed the session, for OnClose. The code
+	// is 0 if the client did not close it, and 1006 if its connection was
+	// lost without a close message
+	ClientCloseCode int
+	ClientCloseText string
+
+	// tracer is nil if tracing is disabled
+	tracer Logger
+	// sanitizeInfo is Settings.SanitizeInfo
+	sanitizeInfo bool
+	// onFrame is Settings.OnFrame, once the connection is paired
+	onFrame func(dir string, data []byte)
+	// writeMu serializes the writes to Conn, so that the gateway's own
+	// commands never get interleaved with a client's
+	writeMu sync.Mutex
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// TLSVersion returns the TLS version negotiated with the NATS server, for
+// example "TLS 1.3", or "" if the connection is not encrypted
+func (c *NatsConn) TLSVersion() string {
+	if c.TLSState == nil {
+		return ""
+	}
+	return tls.VersionName(c.TLSState.Version)
+}
+
+// TLSCipherSuite returns the name of the cipher suite negotiated with the
+// NATS server, or "" if the connection is not encrypted
+func (c *NatsConn) TLSCipherSuite() string {
+	if c.TLSState == nil {
+		return ""
+	}
+	return tls.CipherSuiteName(c.TLSState.CipherSuite)
+}
+
+// Close closes the connection to the NATS server, including its TLS layer if
+// any. It can safely be called several times
+func (c *NatsConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.Conn.Close()
+	})
+	return c.closeErr
+}
+
+// forwardInfo sends the server INFO to the websocket client, keeping only the
+// fields the clients need if Settings.SanitizeInfo is set
+func (c *NatsConn) forwardInfo(wsConn *websocket.Conn) error {
+	info := c.ServerInfo
+	if c.sanitizeInfo {
+		info = c.Info.sanitized()
+	}
+	infoCmd := append([]byte("INFO "), []byte(info)...)
+	infoCmd = append(infoCmd, byte('\r'), byte('\n'))
+	if c.tracer != nil {
+		c.tracer.Tracef("<-- %s", infoCmd)
+	}
+	if c.onFrame != nil {
+		c.onFrame(DirNatsToWS, infoCmd)
+	}
+	return wsConn.WriteMessage(websocket.TextMessage, infoCmd)
+}
+
+// writeCommand sends a command to the NATS server
+func (c *NatsConn) writeCommand(cmd []byte) error {
+	if c.tracer != nil {
+		c.tracer.Tracef("--> %s", cmd)
+	}
+	if c.onFrame != nil {
+		c.onFrame(DirWSToNats, cmd)
+	}
+	_, err := c.write(cmd)
+	return err
+}
+
+func (c *NatsConn) write(data []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.Write(data)
 }
 
 func (gw *Gateway) defaultConnectHandler(natsConn *NatsConn, r *http.Request, wsConn *websocket.Conn) error {
 	// Default behavior is to let the client on the other side do the CONNECT
 	// after having forwarded the 'INFO' command
-	infoCmd := append([]byte("INFO "), []byte(natsConn.ServerInfo)...)
-	infoCmd = append(infoCmd, byte('\r'), byte('\n'))
-	if gw.settings.Trace {
-		fmt.Println("[TRACE] <--", string(infoCmd))
+	if len(gw.settings.HeaderToConnectField) != 0 {
+		options := make(map[string]string)
+		for header, field := range gw.settings.HeaderToConnectField {
+			if value := r.Header.Get(header); value != "" {
+				options[field] = value
+			}
+		}
+		if len(options) != 0 {
+			if err := writeConnect(natsConn, options); err != nil {
+				return err
+			}
+		}
+	}
+	return natsConn.forwardInfo(wsConn)
+}
+
+func (gw *Gateway) defaultErrorHandler(err error) {
+	gw.logger.Errorf("%s", err)
+}
+
+// Validate checks the settings for misconfigurations. The returned error
+// names the offending field
+func (s Settings) Validate() error {
+	if s.NatsAddr == "" && len(s.NatsAddrs) == 0 {
+		return fmt.Errorf("Invalid settings: NatsAddr is empty")
 	}
-	if err := wsConn.WriteMessage(websocket.TextMessage, infoCmd); err != nil {
+	for _, addr := range s.NatsAddrs {
+		if addr == "" {
+			return fmt.Errorf("Invalid settings: NatsAddrs contains an empty address")
+		}
+	}
+	s, err := s.withParsedAddrs()
+	if err != nil {
 		return err
 	}
+	if s.NatsNetwork != "" && s.NatsNetwork != "tcp" && s.NatsNetwork != "unix" {
+		return fmt.Errorf("Invalid settings: NatsNetwork must be 'tcp' or 'unix'")
+	}
+	if s.NatsTLSConfig != nil && s.TLSConfig != nil {
+		return fmt.Errorf("Invalid settings: both NatsTLSConfig and TLSConfig are set")
+	}
+	if s.NatsTLSConfig != nil && !s.EnableTLS {
+		return fmt.Errorf("Invalid settings: NatsTLSConfig is set but EnableTLS is false")
+	}
+	if s.TLSConfig != nil && !s.EnableTLS {
+		return fmt.Errorf("Invalid settings: TLSConfig is set but EnableTLS is false")
+	}
+	if s.NatsNetwork == "unix" && s.EnableTLS && !s.NatsTLSInsecure {
+		config := s.NatsTLSConfig
+		if config == nil {
+			config = s.TLSConfig
+		}
+		if config == nil || (config.ServerName == "" && !config.InsecureSkipVerify) {
+			return fmt.Errorf("Invalid settings: EnableTLS over a unix NatsNetwork needs NatsTLSConfig.ServerName")
+		}
+	}
+	if s.ReadOnly && s.WriteOnly {
+		return fmt.Errorf("Invalid settings: both ReadOnly and WriteOnly are set")
+	}
+	if s.GatewayManagedConnect && s.ConnectBuilder == nil {
+		return fmt.Errorf("Invalid settings: GatewayManagedConnect is set but ConnectBuilder is nil")
+	}
+	if s.GatewayManagedConnect && s.ConnectHandler != nil {
+		return fmt.Errorf("Invalid settings: both GatewayManagedConnect and ConnectHandler are set")
+	}
+	if (s.NatsClientCert == "") != (s.NatsClientKey == "") {
+		return fmt.Errorf("Invalid settings: NatsClientCert and NatsClientKey must be set together")
+	}
+	if s.NatsClientCert != "" {
+		if _, err := tls.LoadX509KeyPair(s.NatsClientCert, s.NatsClientKey); err != nil {
+			return fmt.Errorf("Invalid settings: NatsClientCert: %s", err)
+		}
+	}
+	if s.MaxConnections < 0 {
+		return fmt.Errorf("Invalid settings: MaxConnections is negative")
+	}
+	if s.CopyBufferSize < 0 {
+		return fmt.Errorf("Invalid settings: CopyBufferSize is negative")
+	}
+	if s.ReadBufferSize < 0 {
+		return fmt.Errorf("Invalid settings: ReadBufferSize is negative")
+	}
+	if s.MaxControlLine < 0 {
+		return fmt.Errorf("Invalid settings: MaxControlLine is negative")
+	}
+	if s.MaxCommandSize < 0 {
+		return fmt.Errorf("Invalid settings: MaxCommandSize is negative")
+	}
+	if s.MaxWSMessageSize < 0 {
+		return fmt.Errorf("Invalid settings: MaxWSMessageSize is negative")
+	}
+	if s.ProxyProtocolVersion < 0 || s.ProxyProtocolVersion > 2 {
+		return fmt.Errorf("Invalid settings: ProxyProtocolVersion must be 1 or 2")
+	}
+	if _, err := parseTrustedProxies(s.TrustedProxies); err != nil {
+		return fmt.Errorf("Invalid settings: %s", err)
+	}
+	if s.CompressionLevel < -2 || s.CompressionLevel > 9 {
+		return fmt.Errorf("Invalid settings: CompressionLevel is not within -2-9")
+	}
+	if s.CompressionMinSize < 0 {
+		return fmt.Errorf("Invalid settings: CompressionMinSize is negative")
+	}
+	if s.BatchWindow < 0 {
+		return fmt.Errorf("Invalid settings: BatchWindow is negative")
+	}
+	if s.BatchMaxBytes < 0 {
+		return fmt.Errorf("Invalid settings: BatchMaxBytes is negative")
+	}
+	if s.DrainTimeout < 0 {
+		return fmt.Errorf("Invalid settings: DrainTimeout is negative")
+	}
+	if s.WSPingInterval < 0 {
+		return fmt.Errorf("Invalid settings: WSPingInterval is negative")
+	}
+	if s.WSPongTimeout < 0 {
+		return fmt.Errorf("Invalid settings: WSPongTimeout is negative")
+	}
+	if s.InfoReadTimeout < 0 {
+		return fmt.Errorf("Invalid settings: InfoReadTimeout is negative")
+	}
+	if s.MaxInfoSize < 0 {
+		return fmt.Errorf("Invalid settings: MaxInfoSize is negative")
+	}
+	if s.ConnectRetries < 0 {
+		return fmt.Errorf("Invalid settings: ConnectRetries is negative")
+	}
+	if s.ConnectBackoff < 0 {
+		return fmt.Errorf("Invalid settings: ConnectBackoff is negative")
+	}
+	if s.BreakerThreshold < 0 {
+		return fmt.Errorf("Invalid settings: BreakerThreshold is negative")
+	}
+	if s.BreakerCooldown < 0 {
+		return fmt.Errorf("Invalid settings: BreakerCooldown is negative")
+	}
+	if s.PoolSize < 0 {
+		return fmt.Errorf("Invalid settings: PoolSize is negative")
+	}
+	if s.PoolIdleTimeout < 0 {
+		return fmt.Errorf("Invalid settings: PoolIdleTimeout is negative")
+	}
+	if s.MaxMessagesPerSecond < 0 {
+		return fmt.Errorf("Invalid settings: MaxMessagesPerSecond is negative")
+	}
+	if s.MessagesBurst < 0 {
+		return fmt.Errorf("Invalid settings: MessagesBurst is negative")
+	}
+	if s.MaxBytesPerSecond < 0 {
+		return fmt.Errorf("Invalid settings: MaxBytesPerSecond is negative")
+	}
+	if s.BytesBurst < 0 {
+		return fmt.Errorf("Invalid settings: BytesBurst is negative")
+	}
+	if s.OutboundQueueSize < 0 {
+		return fmt.Errorf("Invalid settings: OutboundQueueSize is negative")
+	}
+	if s.WSUpgrader != nil {
+		if s.WSUpgrader.ReadBufferSize < 0 {
+			return fmt.Errorf("Invalid settings: WSUpgrader.ReadBufferSize is negative")
+		}
+		if s.WSUpgrader.WriteBufferSize < 0 {
+			return fmt.Errorf("Invalid settings: WSUpgrader.WriteBufferSize is negative")
+		}
+	}
+	if s.WSReadBufferSize < 0 {
+		return fmt.Errorf("Invalid settings: WSReadBufferSize is negative")
+	}
+	if s.WSWriteBufferSize < 0 {
+		return fmt.Errorf("Invalid settings: WSWriteBufferSize is negative")
+	}
+	if s.WSReuseServerBuffers && (s.WSReadBufferSize > 0 || s.WSWriteBufferSize > 0) {
+		return fmt.Errorf("Invalid settings: both WSReuseServerBuffers and WSReadBufferSize or WSWriteBufferSize are set")
+	}
 	return nil
 }
 
-func defaultErrorHandler(err error) {
-	fmt.Println("[ERROR]", err)
+// natsTLSConfig returns the TLS configuration of the NATS connections
+func (s Settings) natsTLSConfig() (*tls.Config, error) {
+	config := s.NatsTLSConfig
+	if config == nil {
+		config = s.TLSConfig
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if s.NatsTLSInsecure {
+		config = config.Clone()
+		config.InsecureSkipVerify = true
+	}
+	if s.NatsClientCert == "" && s.NatsClientKey == "" {
+		return config, nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.NatsClientCert, s.NatsClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading the NATS client certificate: %w", err)
+	}
+	config = config.Clone()
+	config.Certificates = append(config.Certificates, cert)
+	return config, nil
 }
 
-func copyAndTrace(prefix string, dst io.Writer, src io.Reader, buf []byte) (int64, error) {
-	read, err := src.Read(buf)
-	if err != nil {
-		return 0, err
+// natsTLSConfigFor returns the TLS configuration for dialing addr: unless set,
+// the ServerName is the host of addr, for the SNI and the verification of
+// the server certificate. An IP address is not used, as it cannot be sent as
+// SNI, and neither is a unix socket path
+func natsTLSConfigFor(config *tls.Config, addr string) *tls.Config {
+	if config.ServerName != "" {
+		return config
 	}
-	fmt.Println("[TRACE]", prefix, string(buf[:read]))
-	written, err := dst.Write(buf[:read])
-	if written != read {
-		return int64(written), io.ErrShortWrite
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || net.ParseIP(host) != nil {
+		return config
 	}
-	return int64(written), err
+	config = config.Clone()
+	config.ServerName = host
+	return config
 }
 
-// NewGateway instanciates a Gateway
+// NewGatewayWithValidation instanciates a Gateway after validating the
+// settings
+func NewGatewayWithValidation(settings Settings) (*Gateway, error) {
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
+	return NewGateway(settings), nil
+}
+
+// NewGateway instanciates a Gateway. The settings are not validated, see
+// NewGatewayWithValidation
 func NewGateway(settings Settings) *Gateway {
+	// invalid addresses are reported by Validate, and fail the connections
+	if parsed, err := settings.withParsedAddrs(); err == nil {
+		settings = parsed
+	}
 	gw := Gateway{
 		settings: settings,
+		conns:    make(map[*connPair]struct{}),
+	}
+	copyBufferSize := settings.CopyBufferSize
+	if copyBufferSize <= 0 {
+		copyBufferSize = defaultCopyBufferSize
 	}
+	gw.copyBuffers.New = func() interface{} {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	}
+	gw.natsTLSConfig, gw.natsTLSErr = settings.natsTLSConfig()
+	// invalid proxies are reported by Validate
+	gw.trustedProxies, _ = parseTrustedProxies(settings.TrustedProxies)
+	if settings.ReuseConnections {
+		gw.pool = newConnPool(settings.PoolSize, settings.PoolIdleTimeout)
+	}
+	if settings.MaxConnections > 0 {
+		gw.connSem = make(chan struct{}, settings.MaxConnections)
+	}
+	if settings.BreakerThreshold > 0 {
+		gw.breaker = newCircuitBreaker(settings.BreakerThreshold, settings.BreakerCooldown)
+	}
+	gw.setLogger(settings.Logger)
+	gw.setMetrics(settings.Metrics)
 	gw.setErrorHandler(settings.ErrorHandler)
 	gw.setConnectHandler(settings.ConnectHandler)
 	return &gw
 }
 
+func (gw *Gateway) setLogger(logger Logger) {
+	if logger == nil {
+		gw.logger = defaultLogger
+	} else {
+		gw.logger = logger
+	}
+}
+
+func (gw *Gateway) setMetrics(metrics Metrics) {
+	if metrics == nil {
+		gw.metrics = NoopMetrics{}
+	} else {
+		gw.metrics = metrics
+	}
+}
+
 func (gw *Gateway) setErrorHandler(handler ErrorHandler) {
 	if handler == nil {
-		gw.onError = defaultErrorHandler
-	} else {
-		gw.onError = handler
+		handler = gw.defaultErrorHandler
+	}
+	gw.onError = func(err error) {
+		gw.metrics.IncErrors()
+		handler(err)
+	}
+}
+
+// isDisconnect tells if err denotes a normal termination of the connection
+func isDisconnect(err error) bool {
+	var closeErr *websocket.CloseError
+	return errors.As(err, &closeErr) || errors.Is(err, io.EOF) ||
+		errors.Is(err, context.Canceled)
+}
+
+// closeMessage returns the websocket close message sent to the client when
+// its pair is torn down after err
+func (gw *Gateway) closeMessage(err error) (int, string) {
+	if gw.settings.CloseMessageFunc != nil {
+		return gw.settings.CloseMessageFunc(err)
+	}
+	if err == nil || isDisconnect(err) {
+		return websocket.CloseNormalClosure, ""
+	}
+	if errors.Is(err, ErrWSMessageTooLarge) {
+		return websocket.CloseMessageTooBig, ""
 	}
+	if errors.Is(err, ErrAuthorization) {
+		return websocket.ClosePolicyViolation, "NATS authorization failed"
+	}
+	return websocket.CloseInternalServerErr, "internal error"
+}
+
+// connError reports the first error of a connection pair. A normal
+// disconnection is reported to OnDisconnect instead of the ErrorHandler
+func (gw *Gateway) connError(pair *connPair, err error) {
+	if errors.Is(err, websocket.ErrReadLimit) {
+		err = ErrWSMessageTooLarge
+	}
+	pair.errOnce.Do(func() {
+		pair.err = err
+		if isDisconnect(err) {
+			if gw.settings.OnDisconnect != nil {
+				gw.settings.OnDisconnect(err)
+			}
+			return
+		}
+		gw.onError(&ConnError{ID: pair.id, Err: err})
+	})
 }
 
 func (gw *Gateway) setConnectHandler(handler ConnectHandler) {
-	if handler == nil {
+	if gw.settings.GatewayManagedConnect {
+		gw.handleConnect = gw.managedConnectHandler
+	} else if handler == nil {
 		gw.handleConnect = gw.defaultConnectHandler
 	} else {
 		gw.handleConnect = handler
 	}
 }
 
-func (gw *Gateway) natsToWsWorker(messageType int, ws *websocket.Conn, src CommandsReader, doneCh chan<- bool) {
+// natsReadError handles an error reading from the NATS server. Unless the
+// gateway closed the pair itself, the websocket client is sent a close
+// message telling the upstream connection failed, so that it can tell it
+// apart from its own disconnection
+func natsReadError(pair *connPair, err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() && pair.idleTimeout > 0 {
+		err = ErrIdleTimeout
+	}
+	if pair.closed.Load() {
+		return err
+	}
+	code, reason := websocket.CloseInternalServerErr, "upstream NATS closed"
+	var tooLarge *CommandTooLargeError
+	if errors.As(err, &tooLarge) {
+		code, reason = websocket.CloseMessageTooBig, "NATS command too large"
+	} else if err == ErrIdleTimeout {
+		reason = "NATS connection idle timeout"
+	}
+	pair.wsConn.writeClose(code, reason)
+	return err
+}
+
+// readNatsCommand reads the next command from the NATS server. A nil command
+// must be ignored
+func (gw *Gateway) readNatsCommand(pair *connPair) ([]byte, error) {
+	pair.resetIdleDeadline()
+	cmd, err := pair.natsConn.CmdReader.NextCommand()
+	if err != nil {
+		return nil, natsReadError(pair, err)
+	}
+	if gw.settings.HandlePing && bytes.Equal(cmd, []byte("PING\r\n")) {
+		if err := pair.natsConn.writeCommand([]byte("PONG\r\n")); err != nil {
+			return nil, err
+		}
+		pair.stats.AutoPongs.Add(1)
+		return nil, nil
+	}
+	if gw.settings.SubjectMapper != nil {
+		cmd = mapSubjects(cmd, gw.settings.SubjectMapper.MapIncoming)
+	}
+	if gw.settings.OutboundFilter != nil {
+		filtered, ok := gw.settings.OutboundFilter(cmd)
+		if !ok {
+			return nil, nil
+		}
+		cmd = filtered
+	}
+	if gw.settings.SubjectMetrics != nil {
+		if subject, ok := msgSubject(cmd); ok {
+			gw.settings.SubjectMetrics(DirNatsToWS, subject)
+		}
+	}
+	return cmd, nil
+}
+
+// observe traces data forwarded in the dir direction, and passes it to
+// Settings.OnFrame
+func (gw *Gateway) observe(pair *connPair, dir string, data []byte) {
+	if gw.settings.Trace {
+		prefix := "-->"
+		if dir == DirNatsToWS {
+			prefix = "<--"
+		}
+		pair.logger.Tracef("%s %s", prefix, data)
+	}
+	if gw.settings.OnFrame != nil {
+		gw.settings.OnFrame(dir, data)
+	}
+}
+
+// writeWSCommand writes a NATS command to the websocket
+func (gw *Gateway) writeWSCommand(messageType int, pair *connPair, cmd []byte) error {
+	gw.observe(pair, DirNatsToWS, cmd)
+	if err := pair.wsConn.WriteMessage(messageType, cmd); err != nil {
+		return err
+	}
+	pair.stats.BytesNatsToWS.Add(int64(len(cmd)))
+	gw.metrics.AddBytes(DirNatsToWS, int64(len(cmd)))
+	return nil
+}
+
+// closeOnServerErr closes the websocket with a close code matching a fatal
+// -ERR sent by the NATS server, in which case a *ServerError is returned
+func (gw *Gateway) closeOnServerErr(pair *connPair, cmd []byte) error {
+	reason, ok := ParseErr(cmd)
+	if !ok {
+		return nil
+	}
+	code, fatal := serverErrCloseCode(reason)
+	if !fatal {
+		return nil
+	}
+	pair.wsConn.writeClose(code, reason)
+	return &ServerError{Reason: reason}
+}
+
+func (gw *Gateway) natsToWsWorker(messageType int, pair *connPair, doneCh chan<- bool) {
 	defer func() {
 		doneCh <- true
 	}()
+	if gw.settings.ForwardPartial {
+		gw.natsToWsPartial(messageType, pair)
+		return
+	}
+	if size := gw.settings.OutboundQueueSize; size > 0 || gw.settings.BatchWindow > 0 {
+		gw.natsToWsQueued(messageType, pair, size)
+		return
+	}
 
 	for {
-		cmd, err := src.nextCommand()
+		cmd, err := gw.readNatsCommand(pair)
 		if err != nil {
-			gw.onError(err)
+			gw.connError(pair, err)
 			return
 		}
 		// ignore, continue
 		if cmd == nil {
 			continue
 		}
-		if gw.settings.Trace {
-			fmt.Println("[TRACE] <--", string(cmd))
+		if err := gw.writeWSCommand(messageType, pair, cmd); err != nil {
+			gw.connError(pair, err)
+			return
+		}
+		if err := gw.closeOnServerErr(pair, cmd); err != nil {
+			gw.connError(pair, err)
+			return
+		}
+	}
+}
+
+// natsToWsPartial forwards the NATS input stream to the websocket as soon as
+// it is read, without waiting for whole commands
+func (gw *Gateway) natsToWsPartial(messageType int, pair *connPair) {
+	buf := gw.copyBuffers.Get().(*[]byte)
+	defer gw.copyBuffers.Put(buf)
+	for {
+		pair.resetIdleDeadline()
+		n, err := pair.natsConn.CmdReader.Read(*buf)
+		if n > 0 {
+			if err := gw.writeWSCommand(messageType, pair, (*buf)[:n]); err != nil {
+				gw.connError(pair, err)
+				return
+			}
 		}
-		if err := ws.WriteMessage(messageType, cmd); err != nil {
-			gw.onError(err)
+		if err != nil {
+			gw.connError(pair, natsReadError(pair, err))
 			return
 		}
 	}
 }
 
-func (gw *Gateway) wsToNatsWorker(messageType int, nats net.Conn, ws *websocket.Conn, doneCh chan<- bool) {
+// natsToWsQueued forwards the NATS commands to the websocket through a
+// bounded queue, so that reading from NATS is not slowed down by the
+// websocket writes
+func (gw *Gateway) natsToWsQueued(messageType int, pair *connPair, size int) {
+	queue := make(chan []byte, size)
+	stop := make(chan struct{})
+	readerDone := make(chan struct{})
+	defer func() {
+		close(stop)
+		// the reader must be done with the NATS connection before it can
+		// be reused
+		pair.natsConn.Conn.SetReadDeadline(time.Now())
+		<-readerDone
+	}()
+
+	var readErr error
+	go func() {
+		defer close(readerDone)
+		defer close(queue)
+		for {
+			cmd, err := gw.readNatsCommand(pair)
+			if err != nil {
+				readErr = err
+				return
+			}
+			if cmd == nil {
+				continue
+			}
+			select {
+			case queue <- cmd:
+				continue
+			case <-stop:
+				return
+			default:
+			}
+			if gw.settings.OutboundDropOldest {
+				// only this goroutine pushes, so there is room once the
+				// oldest command is dropped
+				select {
+				case <-queue:
+					pair.stats.DroppedNatsToWS.Add(1)
+				default:
+				}
+				queue <- cmd
+				continue
+			}
+			select {
+			case queue <- cmd:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var err error
+	if gw.settings.BatchWindow > 0 {
+		err = gw.natsToWsBatched(messageType, pair, queue)
+	} else {
+		for cmd := range queue {
+			if err = gw.writeWSCommand(messageType, pair, cmd); err != nil {
+				break
+			}
+			if err = gw.closeOnServerErr(pair, cmd); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		gw.connError(pair, err)
+		return
+	}
+	gw.connError(pair, readErr)
+}
+
+// natsToWsBatched forwards the queued NATS commands to the websocket,
+// coalescing the commands received within Settings.BatchWindow into single
+// messages of at most Settings.BatchMaxBytes. The NATS commands being
+// self-delimiting, the client can split the messages back into commands.
+// A -ERR always ends a batch, so that a fatal one closes the websocket
+// right after being sent
+func (gw *Gateway) natsToWsBatched(messageType int, pair *connPair, queue <-chan []byte) error {
+	maxBytes := gw.settings.BatchMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultBatchMaxBytes
+	}
+	var batch, next []byte
+	for {
+		if next == nil {
+			cmd, ok := <-queue
+			if !ok {
+				return nil
+			}
+			next = cmd
+		}
+		batch = append(batch[:0], next...)
+		last := next
+		next = nil
+		closed := false
+		timer := time.NewTimer(gw.settings.BatchWindow)
+	collect:
+		for len(batch) < maxBytes && !bytes.HasPrefix(last, []byte("-ERR")) {
+			select {
+			case cmd, ok := <-queue:
+				if !ok {
+					closed = true
+					break collect
+				}
+				if len(batch)+len(cmd) > maxBytes {
+					next = cmd
+					break collect
+				}
+				batch = append(batch, cmd...)
+				last = cmd
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		if err := gw.writeWSCommand(messageType, pair, batch); err != nil {
+			return err
+		}
+		if err := gw.closeOnServerErr(pair, last); err != nil {
+			return err
+		}
+		if closed {
+			return nil
+		}
+	}
+}
+
+func (gw *Gateway) wsToNatsWorker(messageType int, pair *connPair, doneCh chan<- bool) {
 	defer func() {
 		doneCh <- true
 	}()
-	var buf []byte
-	if gw.settings.Trace {
-		buf = make([]byte, 1024*1024)
+	if gw.inboundFraming(pair) {
+		gw.wsToNatsCommands(messageType, pair)
+		return
 	}
+	ws := pair.wsConn
+	stats := &pair.stats
 	for {
 		_, src, err := ws.NextReader()
 		if err != nil {
-			gw.onError(err)
+			gw.connError(pair, err)
 			return
 		}
-		if gw.settings.Trace {
-			_, err = copyAndTrace("-->", nats, src, buf)
-		} else {
-			_, err = io.Copy(nats, src)
+		// the message is read, and paced, before taking the write lock: a
+		// client stalling in the middle of a message must not block the
+		// commands of the gateway, like the PONGs
+		buf := gw.copyBuffers.Get().(*[]byte)
+		data, err := readMessage(src, *buf)
+		var n int
+		if err == nil && len(data) > 0 {
+			gw.observe(pair, DirWSToNats, data)
+			if pair.bytes != nil && !pair.paceBytes(len(data)) {
+				err = net.ErrClosed
+			} else {
+				n, err = pair.natsConn.write(data)
+			}
 		}
+		gw.copyBuffers.Put(buf)
+		stats.BytesWSToNats.Add(int64(n))
+		gw.metrics.AddBytes(DirWSToNats, int64(n))
 		if err != nil {
-			gw.onError(err)
+			gw.connError(pair, err)
 			return
 		}
 	}
 }
 
+// readMessage reads a whole websocket message, in buf if it fits, or else in
+// a bigger slice. The message size is bounded by the websocket read limit
+func readMessage(src io.Reader, buf []byte) ([]byte, error) {
+	n := 0
+	for {
+		if n == len(buf) {
+			buf = append(buf, make([]byte, len(buf)+1)...)
+		}
+		read, err := src.Read(buf[n:])
+		n += read
+		if err == io.EOF {
+			return buf[:n], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// register adds a pair to the set of live connections. It returns false if
+// the gateway is shutting down, in which case the pair must not be served
+func (gw *Gateway) register(pair *connPair) bool {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	if gw.shuttingDown {
+		return false
+	}
+	gw.conns[pair] = struct{}{}
+	gw.connsWg.Add(1)
+	return true
+}
+
+func (gw *Gateway) deregister(pair *connPair) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	if _, ok := gw.conns[pair]; ok {
+		delete(gw.conns, pair)
+		gw.connsWg.Done()
+	}
+}
+
+// ActiveConnections returns the number of live websocket <-> NATS pairs
+func (gw *Gateway) ActiveConnections() int {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return len(gw.conns)
+}
+
+func (gw *Gateway) isShuttingDown() bool {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return gw.shuttingDown
+}
+
+// Shutdown gracefully shuts down the gateway: new connections are refused,
+// the active ones are asked to close, and Shutdown waits for them to
+// terminate. If ctx expires before that, the remaining connections are
+// forcibly closed and an error is returned. The servers started by
+// ListenAndServe are shut down too.
+func (gw *Gateway) Shutdown(ctx context.Context) error {
+	gw.mu.Lock()
+	gw.shuttingDown = true
+	pairs := make([]*connPair, 0, len(gw.conns))
+	for pair := range gw.conns {
+		pairs = append(pairs, pair)
+	}
+	gw.mu.Unlock()
+	// a close message may wait behind a blocked write, so they are sent
+	// concurrently, and without holding the lock
+	for _, pair := range pairs {
+		go func(pair *connPair) {
+			if err := pair.wsConn.writeClose(websocket.CloseGoingAway, "gateway shutting down"); err != nil {
+				pair.close()
+			}
+		}(pair)
+	}
+	if gw.pool != nil {
+		gw.pool.Close()
+	}
+	gw.shutdownServers(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		gw.connsWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	gw.mu.Lock()
+	killed := len(gw.conns)
+	for pair := range gw.conns {
+		pair.close()
+	}
+	gw.mu.Unlock()
+
+	if killed == 0 {
+		return nil
+	}
+	return fmt.Errorf("Shutdown: %d connection(s) killed: %s", killed, ctx.Err())
+}
+
 // Handler is a HTTP handler function
 func (gw *Gateway) Handler(w http.ResponseWriter, r *http.Request) {
+	if gw.isShuttingDown() {
+		http.Error(w, "gateway is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	// websockets over HTTP/2 (RFC 8441) are not supported
+	if r.ProtoMajor != 1 {
+		upgradeRequired(w, fmt.Sprintf(
+			"websocket requires HTTP/1.1, got %s: configure the proxy to forward websockets over HTTP/1.1",
+			r.Proto))
+		return
+	}
+	if gw.settings.RateLimiter != nil &&
+		!gw.settings.RateLimiter.Allow(gw.ClientIP(r)) {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	if gw.connSem != nil {
+		select {
+		case gw.connSem <- struct{}{}:
+			defer func() { <-gw.connSem }()
+		default:
+			http.Error(w, "too many connections", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if gw.breaker != nil && !gw.breaker.allow(time.Now()) {
+		http.Error(w, "NATS unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	r = withConnValues(r)
+	if gw.settings.PreUpgrade != nil && !gw.settings.PreUpgrade(w, r) {
+		return
+	}
 	upgrader := defaultUpgrader
 	if gw.settings.WSUpgrader != nil {
 		upgrader = *gw.settings.WSUpgrader
 	}
-	upgrader.CheckOrigin = func(r *http.Request) bool {
-		return true
+	if gw.settings.WSReuseServerBuffers {
+		// gorilla/websocket uses the hijacked buffers when the sizes are 0
+		upgrader.ReadBufferSize, upgrader.WriteBufferSize = 0, 0
+	}
+	if gw.settings.WSReadBufferSize > 0 {
+		upgrader.ReadBufferSize = gw.settings.WSReadBufferSize
+	}
+	if gw.settings.WSWriteBufferSize > 0 {
+		upgrader.WriteBufferSize = gw.settings.WSWriteBufferSize
+	}
+	if gw.settings.CheckOrigin != nil {
+		upgrader.CheckOrigin = gw.settings.CheckOrigin
+	} else if upgrader.CheckOrigin == nil {
+		gw.originWarning.Do(func() {
+			gw.logger.Warnf("No origin check configured, accepting websockets from any origin")
+		})
+		upgrader.CheckOrigin = func(r *http.Request) bool {
+			return true
+		}
 	}
-	wsConn, err := upgrader.Upgrade(w, r, nil)
+	if len(gw.settings.Subprotocols) != 0 {
+		upgrader.Subprotocols = gw.settings.Subprotocols
+	}
+	if gw.settings.EnableCompression {
+		upgrader.EnableCompression = true
+	}
+	if upgrader.Error == nil {
+		upgrader.Error = upgradeError
+	}
+	id := newConnID()
+	// with retries, NATS is connected before the upgrade so that the
+	// failure can be answered with a 503
+	var natsConn *NatsConn
+	if gw.settings.ConnectRetries > 0 {
+		var err error
+		natsConn, err = gw.connectNatsWithRetries(r)
+		if err != nil {
+			gw.onError(&ConnError{ID: id, Err: err})
+			http.Error(w, "NATS connection failed", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	var responseHeader http.Header
+	if gw.settings.ResponseHeader != nil {
+		responseHeader = gw.settings.ResponseHeader(r)
+	}
+	wsConn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
-		gw.onError(err)
+		gw.onError(&ConnError{ID: id, Err: fmt.Errorf("%w: %w", ErrUpgrade, err)})
+		if natsConn != nil {
+			natsConn.Close()
+		}
 		return
 	}
-	natsConn, err := gw.initNatsConnectionForWSConn(r, wsConn)
+	mode, err := gw.connMode(r, wsConn.Subprotocol())
 	if err != nil {
-		gw.onError(err)
+		gw.onError(&ConnError{ID: id, Err: err})
+		closeWithMessage(wsConn, websocket.ClosePolicyViolation, err.Error())
+		if natsConn != nil {
+			natsConn.Close()
+		}
+		return
+	}
+	compressed := upgrader.EnableCompression && offersCompression(r)
+	natsConn, err = gw.initNatsConnectionForWSConn(r, wsConn, natsConn, id, compressed)
+	if err != nil {
+		gw.onError(&ConnError{ID: id, Err: err})
+		code, reason := websocket.CloseInternalServerErr, "NATS connection failed"
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			reason = "NATS connection timeout"
+		} else if errors.Is(err, ErrAuthorization) {
+			code, reason = websocket.ClosePolicyViolation, "NATS authorization failed"
+		}
+		closeWithMessage(wsConn, code, reason)
 		return
 	}
 
-	doneCh := make(chan bool)
+	pair := &connPair{
+		request:     r,
+		id:          id,
+		logger:      connLogger{Logger: gw.logger, id: id},
+		wsConn:      newSafeConn(wsConn, gw.settings.WriteTimeout),
+		natsConn:    natsConn,
+		idleTimeout: gw.settings.IdleTimeout,
+		done:        make(chan struct{}),
+	}
+	if rate := gw.settings.MaxMessagesPerSecond; rate > 0 {
+		burst := gw.settings.MessagesBurst
+		if burst <= 0 {
+			burst = int(math.Max(1, math.Ceil(rate)))
+		}
+		pair.messages = newTokenBucket(rate, burst, time.Now())
+	}
+	if rate := gw.settings.MaxBytesPerSecond; rate > 0 {
+		burst := gw.settings.BytesBurst
+		if burst <= 0 {
+			burst = rate
+		}
+		pair.bytes = newTokenBucket(float64(rate), burst, time.Now())
+		pair.stats.BytesQuota.Store(int64(burst))
+	}
+	if gw.pool != nil {
+		pair.subs = make(map[string]struct{})
+	}
+	// enabling the write compression is a no-op if the client did not
+	// negotiate it
+	if upgrader.EnableCompression {
+		pair.wsConn.compressionMinSize = gw.settings.CompressionMinSize
+		if level := gw.settings.CompressionLevel; level != 0 {
+			wsConn.SetCompressionLevel(level)
+		}
+	}
+	if !gw.register(pair) {
+		pair.close()
+		return
+	}
+	defer gw.deregister(pair)
+	wsConn.SetReadLimit(gw.maxWSMessageSize(natsConn.Info))
+	if gw.settings.RespondToWSPing {
+		wsConn.SetPingHandler(pair.handleWSPing)
+	}
+	if interval := gw.settings.WSPingInterval; interval > 0 {
+		timeout := gw.settings.WSPongTimeout
+		if timeout <= 0 {
+			timeout = interval
+		}
+		pongs := make(chan struct{}, 1)
+		wsConn.SetPongHandler(func(string) error {
+			select {
+			case pongs <- struct{}{}:
+			default:
+			}
+			return nil
+		})
+		go gw.keepalive(pair, pongs, interval, timeout)
+	}
+	gw.metrics.IncConnections()
+	if tlsMetrics, ok := gw.metrics.(TLSMetrics); ok && natsConn.TLSState != nil {
+		tlsMetrics.IncTLSConnections()
+	}
+	if compressionMetrics, ok := gw.metrics.(CompressionMetrics); ok {
+		compressionMetrics.IncConnectionsByCompression(natsConn.Compressed)
+	}
+	defer gw.metrics.DecConnections()
+	if gw.settings.OnConnect != nil {
+		gw.settings.OnConnect(r, natsConn)
+	}
+
+	// buffered, so that a worker outliving the DrainTimeout does not block
+	doneCh := make(chan bool, 2)
+
+	go gw.natsToWsWorker(int(mode), pair, doneCh)
+	go gw.wsToNatsWorker(int(mode), pair, doneCh)
+
+	// wait for a worker to stop, or for the request to be canceled
+	running := 2
+	select {
+	case <-doneCh:
+		running--
+	case <-r.Context().Done():
+		gw.connError(pair, r.Context().Err())
+	}
+
+	if code, text := gw.closeMessage(pair.err); code != 0 {
+		// a no-op if a close message was already sent
+		pair.wsConn.writeClose(code, text)
+	}
+
+	// closing the connections unblocks the remaining workers
+	reuse := gw.pool != nil && reusable(pair.err)
+	if reuse {
+		pair.release()
+	} else {
+		pair.close()
+	}
+
+	if !gw.drain(pair, doneCh, running) {
+		pair.logger.Warnf("A worker did not stop within %s, giving up on it",
+			gw.settings.DrainTimeout)
+		// the worker may still use the NATS connection
+		reuse = false
+		natsConn.Close()
+	}
 
-	var mode = websocket.TextMessage
-	if value, ok := r.URL.Query()["mode"]; ok {
-		if len(value) == 1 && value[0] == "binary" {
-			mode = websocket.BinaryMessage
+	if gw.settings.OnConnClose != nil {
+		gw.settings.OnConnClose(&pair.stats)
+	}
+	if gw.settings.OnClose != nil {
+		err := pair.err
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			natsConn.ClientCloseCode, natsConn.ClientCloseText = closeErr.Code, closeErr.Text
+		}
+		if isDisconnect(err) {
+			err = nil
 		}
+		gw.settings.OnClose(r, natsConn, err)
 	}
+	// only once the hooks are done with it, as another session may get it
+	if reuse {
+		gw.releaseNatsConn(pair)
+	}
+}
 
-	go gw.natsToWsWorker(mode, wsConn, natsConn.CmdReader, doneCh)
-	go gw.wsToNatsWorker(mode, natsConn.Conn, wsConn, doneCh)
+// drain waits for the running workers of a closed pair to stop, for at most
+// Settings.DrainTimeout if set. It returns false on timeout
+func (gw *Gateway) drain(pair *connPair, doneCh <-chan bool, running int) bool {
+	var timeout <-chan time.Time
+	if gw.settings.DrainTimeout > 0 {
+		timer := time.NewTimer(gw.settings.DrainTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for ; running > 0; running-- {
+		select {
+		case <-doneCh:
+		case <-timeout:
+			return false
+		}
+	}
+	return true
+}
 
-	<-doneCh
+// upgradeRequired answers a 426 Upgrade Required
+func upgradeRequired(w http.ResponseWriter, message string) {
+	w.Header().Set("Connection", "Upgrade")
+	w.Header().Set("Upgrade", "websocket")
+	http.Error(w, message, http.StatusUpgradeRequired)
+}
 
-	wsConn.Close()
-	natsConn.Conn.Close()
+// offersCompression tells if a websocket request offers the
+// permessage-deflate extension, which gorilla/websocket then accepts if the
+// compression is enabled, whatever its parameters
+func offersCompression(r *http.Request) bool {
+	for _, header := range r.Header.Values("Sec-Websocket-Extensions") {
+		for _, ext := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	<-doneCh
+// upgradeError is the default websocket.Upgrader.Error. A request lacking the
+// websocket upgrade headers, as when a proxy drops them, gets an explicit
+// 426 instead of a bare 400
+func upgradeError(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	if status == http.StatusBadRequest && !websocket.IsWebSocketUpgrade(r) {
+		upgradeRequired(w, fmt.Sprintf(
+			"%s: the request must be a HTTP/1.1 GET with the 'Connection: Upgrade' and 'Upgrade: websocket' headers, check that the proxies forward them",
+			reason))
+		return
+	}
+	w.Header().Set("Sec-Websocket-Version", "13")
+	http.Error(w, http.StatusText(status), status)
 }
 
+// closeWithMessage sends a close message to the websocket client, then closes
+// the connection
+func closeWithMessage(wsConn *websocket.Conn, code int, reason string) {
+	wsConn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, closeReason(reason)),
+		time.Now().Add(time.Second))
+	wsConn.Close()
+}
+
+// readInfo extracts the json options of an INFO command. Any command that
+// cannot be an INFO (too short, no trailing CRLF...) is an ErrInvalidInfo
 func readInfo(cmd []byte) (NatsServerInfo, error) {
-	if !bytes.Equal(cmd[:5], []byte("INFO ")) {
-		return "", fmt.Errorf("Invalid 'INFO' command: %s", string(cmd))
+	if !bytes.HasPrefix(cmd, []byte("INFO ")) || !bytes.HasSuffix(cmd, []byte("\r\n")) {
+		return "", fmt.Errorf("%w command: %q", ErrInvalidInfo, cmd)
+	}
+	// the spaces around the json are not part of it
+	return NatsServerInfo(bytes.Trim(cmd[5:len(cmd)-2], " \t")), nil
+}
+
+func (gw *Gateway) natsNetwork() string {
+	if gw.settings.NatsNetwork == "" {
+		return "tcp"
+	}
+	return gw.settings.NatsNetwork
+}
+
+func (gw *Gateway) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if gw.settings.Dialer != nil {
+		return gw.customDial(ctx, network, addr)
+	}
+	dialer := net.Dialer{Timeout: gw.settings.DialTimeout}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// customDial calls Settings.Dialer, giving up after Settings.DialTimeout or
+// when ctx is done
+func (gw *Gateway) customDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if gw.settings.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, gw.settings.DialTimeout)
+		defer cancel()
+	}
+	if ctx.Done() == nil {
+		return gw.settings.Dialer(network, addr)
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	dialed := make(chan result, 1)
+	go func() {
+		conn, err := gw.settings.Dialer(network, addr)
+		dialed <- result{conn, err}
+	}()
+	select {
+	case res := <-dialed:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-dialed; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+	}
+}
+
+// newCommandsReader creates a CommandsReader for a NATS connection, sized
+// according to the settings
+func (gw *Gateway) newCommandsReader(conn net.Conn) CommandsReader {
+	return NewCommandsReaderSize(conn, gw.settings.ReadBufferSize, gw.maxCommandSize())
+}
+
+// maxCommandSize returns Settings.MaxCommandSize or its default
+func (gw *Gateway) maxCommandSize() int {
+	if gw.settings.MaxCommandSize > 0 {
+		return gw.settings.MaxCommandSize
+	}
+	return defaultMaxCommandSize
+}
+
+// maxWSMessageSize returns the read limit of the websocket messages for a
+// NATS server
+func (gw *Gateway) maxWSMessageSize(info ServerInfo) int64 {
+	if gw.settings.MaxWSMessageSize > 0 {
+		return gw.settings.MaxWSMessageSize
+	}
+	if info.MaxPayload <= 0 {
+		return int64(gw.maxCommandSize())
 	}
-	return NatsServerInfo(cmd[5 : len(cmd)-2]), nil
+	return info.MaxPayload + int64(gw.maxControlLine()) + 2
 }
 
-// initNatsConnectionForRequest open a connection to the nats server, consume the
-// INFO message if needed, and finally handle the CONNECT
-func (gw *Gateway) initNatsConnectionForWSConn(r *http.Request, wsConn *websocket.Conn) (*NatsConn, error) {
-	conn, err := net.Dial("tcp", gw.settings.NatsAddr)
+// newNatsConn wraps an established connection to a NATS server, whose INFO
+// is yet to be read. The connection can be anything, including an in-memory
+// one, see Settings.Dialer
+func (gw *Gateway) newNatsConn(conn net.Conn) *NatsConn {
+	natsConn := &NatsConn{
+		Conn:       conn,
+		CmdReader:  gw.newCommandsReader(conn),
+		RemoteAddr: conn.RemoteAddr(),
+	}
+	if gw.settings.Trace {
+		natsConn.tracer = gw.logger
+	}
+	return natsConn
+}
+
+// openNatsConn opens a connection to the nats server at addr for the
+// websocket request r (nil for health checks), consumes the INFO message and
+// initializes the TLS layer if needed
+func (gw *Gateway) openNatsConn(ctx context.Context, addr string, r *http.Request) (*NatsConn, error) {
+	conn, err := gw.dial(ctx, gw.natsNetwork(), addr)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrNatsDial, err)
+	}
+	// the context deadline, if any, bounds the INFO exchange
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		conn.SetDeadline(deadline)
+	}
+	natsConn := gw.newNatsConn(conn)
+
+	if gw.settings.SendProxyProtocol {
+		src, dst := requestAddrs(r)
+		header := proxyHeader(gw.settings.ProxyProtocolVersion, src, dst)
+		if _, err := conn.Write(header); err != nil {
+			conn.Close()
+			return nil, err
+		}
 	}
-	natsConn := NatsConn{Conn: conn, CmdReader: NewCommandsReader(conn)}
 
 	// read the INFO, keep it
-	infoCmd, err := natsConn.CmdReader.nextCommand()
+	infoReadTimeout := gw.settings.InfoReadTimeout
+	if infoReadTimeout == 0 {
+		infoReadTimeout = defaultInfoReadTimeout
+	}
+	infoDeadline := time.Now().Add(infoReadTimeout)
+	if !hasDeadline || infoDeadline.Before(deadline) {
+		conn.SetReadDeadline(infoDeadline)
+	}
+	// the reader copy shares the buffer, only its limit differs
+	infoReader := natsConn.CmdReader
+	infoReader.maxCommandSize = gw.settings.MaxInfoSize
+	if infoReader.maxCommandSize == 0 {
+		infoReader.maxCommandSize = defaultMaxInfoSize
+	}
+	infoCmd, err := infoReader.NextCommand()
 	if err != nil {
+		conn.Close()
+		var tooLarge *CommandTooLargeError
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil, fmt.Errorf("%w: %w", ErrInfoTimeout, err)
+		} else if errors.As(err, &tooLarge) {
+			return nil, fmt.Errorf("%w: %w", ErrInfoTooLarge, err)
+		}
 		return nil, err
 	}
+	if hasDeadline {
+		conn.SetReadDeadline(deadline)
+	} else {
+		conn.SetReadDeadline(time.Time{})
+	}
 
 	info, err := readInfo(infoCmd)
 
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
 	natsConn.ServerInfo = info
+	natsConn.Info, err = info.Parse()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 
-	// optionnaly initialize the TLS layer
-	// TODO check if the server requires TLS, which overrides the 'enableTls' setting
-	if gw.settings.EnableTLS {
-		tlsConfig := gw.settings.TLSConfig
-		if tlsConfig == nil {
-			tlsConfig = &tls.Config{
-				InsecureSkipVerify: true,
-			}
+	// optionnaly initialize the TLS layer. A server requiring TLS overrides
+	// the 'EnableTLS' setting
+	tlsRequired := natsConn.Info.TLSRequired
+	if gw.settings.EnableTLS && !tlsRequired && !natsConn.Info.TLSAvailable {
+		conn.Close()
+		return nil, fmt.Errorf("TLS is enabled but not supported by the NATS server")
+	}
+	if gw.settings.EnableTLS || tlsRequired {
+		if gw.natsTLSErr != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%w: %w", ErrTLSHandshake, gw.natsTLSErr)
+		}
+		tlsConfig := natsTLSConfigFor(gw.natsTLSConfig, addr)
+		if tlsConfig.ServerName == "" && !tlsConfig.InsecureSkipVerify && gw.natsNetwork() == "unix" {
+			conn.Close()
+			return nil, fmt.Errorf("%w: NatsTLSConfig.ServerName is needed to verify the NATS server on the unix socket %s", ErrTLSHandshake, addr)
 		}
 		tlsConn := tls.Client(conn, tlsConfig)
-		tlsConn.Handshake()
+		if gw.settings.DialTimeout > 0 {
+			handshakeDeadline := time.Now().Add(gw.settings.DialTimeout)
+			if !hasDeadline || handshakeDeadline.Before(deadline) {
+				tlsConn.SetDeadline(handshakeDeadline)
+			}
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%w: %w", ErrTLSHandshake, err)
+		}
+		tlsConn.SetDeadline(time.Time{})
+		tlsState := tlsConn.ConnectionState()
+		natsConn.TLSState = &tlsState
 		natsConn.Conn = tlsConn
-		natsConn.CmdReader = NewCommandsReader(tlsConn)
+		natsConn.CmdReader = gw.newCommandsReader(tlsConn)
+	} else if hasDeadline {
+		conn.SetDeadline(time.Time{})
+	}
+
+	return natsConn, nil
+}
+
+// connectNats connects to the nats server, recording the outcome in the
+// circuit breaker if any
+func (gw *Gateway) connectNats(ctx context.Context, r *http.Request) (*NatsConn, error) {
+	natsConn, err := gw.connectNatsAddrs(ctx, r)
+	if gw.breaker != nil {
+		if err == nil {
+			gw.breaker.success()
+		} else if ctx.Err() == nil {
+			// a client giving up does not tell anything about NATS
+			gw.breaker.failure(time.Now())
+		}
+	}
+	return natsConn, err
+}
+
+// connectNatsAddrs tries the nats server addresses until a connection
+// succeeds
+func (gw *Gateway) connectNatsAddrs(ctx context.Context, r *http.Request) (*NatsConn, error) {
+	var errs []error
+	for _, addr := range gw.natsAddrs() {
+		natsConn, err := gw.openNatsConn(ctx, addr, r)
+		if err == nil {
+			gw.learnConnectURLs(natsConn.Info.ConnectURLs)
+			return natsConn, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errs) == 1 {
+		return nil, errors.Unwrap(errs[0])
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Healthy checks that the gateway can reach the NATS server: it connects to
+// it exactly like for a websocket client, up to the INFO and the TLS
+// handshake, then closes the connection. It returns nil on success, and is
+// meant to be used by health check endpoints
+func (gw *Gateway) Healthy(ctx context.Context) error {
+	natsConn, err := gw.connectNats(ctx, nil)
+	if err != nil {
+		return err
+	}
+	return natsConn.Close()
+}
+
+// connectNatsWithRetries connects to the nats server, retrying up to
+// Settings.ConnectRetries times with an exponential backoff. The request
+// cancellation interrupts the backoff
+func (gw *Gateway) connectNatsWithRetries(r *http.Request) (*NatsConn, error) {
+	if gw.pool != nil {
+		if natsConn := gw.pool.get(); natsConn != nil {
+			return natsConn, nil
+		}
+	}
+	backoff := gw.settings.ConnectBackoff
+	if backoff <= 0 {
+		backoff = defaultConnectBackoff
+	}
+	for retry := 0; ; retry++ {
+		natsConn, err := gw.connectNats(r.Context(), r)
+		if err == nil || retry >= gw.settings.ConnectRetries {
+			return natsConn, err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// initNatsConnectionForRequest open a connection to the nats server unless
+// natsConn is already connected, consume the INFO message if needed, and
+// finally handle the CONNECT
+func (gw *Gateway) initNatsConnectionForWSConn(r *http.Request, wsConn *websocket.Conn, natsConn *NatsConn, id string, compressed bool) (*NatsConn, error) {
+	if natsConn == nil {
+		var err error
+		natsConn, err = gw.acquireNatsConn(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	natsConn.ID = id
+	natsConn.Subprotocol = wsConn.Subprotocol()
+	natsConn.ClientIP = gw.ClientIP(r)
+	natsConn.Compressed = compressed
+	natsConn.sanitizeInfo = gw.settings.SanitizeInfo
+	natsConn.onFrame = gw.settings.OnFrame
+	if gw.settings.Trace {
+		natsConn.tracer = connLogger{Logger: gw.logger, id: id}
 	}
 
-	if err := gw.handleConnect(&natsConn, r, wsConn); err != nil {
+	if err := gw.handleConnect(natsConn, r, wsConn); err != nil {
+		natsConn.Close()
 		return nil, err
 	}
 
-	return &natsConn, nil
+	return natsConn, nil
 }
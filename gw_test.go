@@ -0,0 +1,1267 @@
+package gw
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gotest.tools/assert"
+)
+
+func TestShutdown(t *testing.T) {
+	gateway := NewGateway(Settings{NatsAddr: "localhost:4222"})
+
+	assert.NilError(t, gateway.Shutdown(context.Background()))
+
+	rec := httptest.NewRecorder()
+	gateway.Handler(rec, httptest.NewRequest("GET", "/nats", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestShutdownSlowConsumers(t *testing.T) {
+	big := strings.Repeat("x", 16*1024*1024)
+	msg := fmt.Sprintf("MSG foo 1 %d\r\n%s\r\n", len(big), big)
+	gateway, server := startTestGateway(t, Settings{Logger: &testLogger{}}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+		conn.Write([]byte(msg))
+		conn.Read(make([]byte, 1))
+	})
+	for i := 0; i < 3; i++ {
+		// the clients never read past the INFO, blocking the writes
+		wsConn := dialTestGateway(t, server)
+		readWSMessage(t, wsConn)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for gateway.ActiveConnections() != 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- gateway.Shutdown(ctx) }()
+	// the lock is not held while the close messages wait
+	time.Sleep(50 * time.Millisecond)
+	gateway.ActiveConnections()
+	assert.Assert(t, time.Since(start) < 150*time.Millisecond)
+
+	<-shutdown
+	assert.Assert(t, time.Since(start) < 900*time.Millisecond, "%s", time.Since(start))
+}
+
+func TestSettingsValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		settings Settings
+		err      string
+	}{
+		{
+			name:     "valid",
+			settings: Settings{NatsAddr: "localhost:4222"},
+		},
+		{
+			name:     "empty NatsAddr",
+			settings: Settings{},
+			err:      "Invalid settings: NatsAddr is empty",
+		},
+		{
+			name: "TLSConfig without EnableTLS",
+			settings: Settings{
+				NatsAddr:  "localhost:4222",
+				TLSConfig: &tls.Config{},
+			},
+			err: "Invalid settings: TLSConfig is set but EnableTLS is false",
+		},
+		{
+			name: "NatsTLSConfig and TLSConfig",
+			settings: Settings{
+				NatsAddr:      "localhost:4222",
+				EnableTLS:     true,
+				NatsTLSConfig: &tls.Config{},
+				TLSConfig:     &tls.Config{},
+			},
+			err: "Invalid settings: both NatsTLSConfig and TLSConfig are set",
+		},
+		{
+			name: "ReadOnly and WriteOnly",
+			settings: Settings{
+				NatsAddr:  "localhost:4222",
+				ReadOnly:  true,
+				WriteOnly: true,
+			},
+			err: "Invalid settings: both ReadOnly and WriteOnly are set",
+		},
+		{
+			name: "GatewayManagedConnect without ConnectBuilder",
+			settings: Settings{
+				NatsAddr:              "localhost:4222",
+				GatewayManagedConnect: true,
+			},
+			err: "Invalid settings: GatewayManagedConnect is set but ConnectBuilder is nil",
+		},
+		{
+			name:     "tls url",
+			settings: Settings{NatsAddr: "tls://localhost", NatsTLSConfig: &tls.Config{}},
+		},
+		{
+			name:     "websocket url",
+			settings: Settings{NatsAddr: "wss://localhost"},
+			err:      `Invalid settings: NatsAddr "wss://localhost": unsupported scheme "wss", expected nats:// or tls://`,
+		},
+		{
+			name: "reused and sized buffers",
+			settings: Settings{
+				NatsAddr:             "localhost:4222",
+				WSReuseServerBuffers: true,
+				WSReadBufferSize:     64 * 1024,
+			},
+			err: "Invalid settings: both WSReuseServerBuffers and WSReadBufferSize or WSWriteBufferSize are set",
+		},
+		{
+			name: "TLS over a unix socket without ServerName",
+			settings: Settings{
+				NatsAddr:    "/var/run/nats.sock",
+				NatsNetwork: "unix",
+				EnableTLS:   true,
+			},
+			err: "Invalid settings: EnableTLS over a unix NatsNetwork needs NatsTLSConfig.ServerName",
+		},
+		{
+			name: "TLS over a unix socket",
+			settings: Settings{
+				NatsAddr:      "/var/run/nats.sock",
+				NatsNetwork:   "unix",
+				EnableTLS:     true,
+				NatsTLSConfig: &tls.Config{ServerName: "nats.local"},
+			},
+		},
+		{
+			name: "negative buffer size",
+			settings: Settings{
+				NatsAddr:   "localhost:4222",
+				WSUpgrader: &websocket.Upgrader{ReadBufferSize: -1},
+			},
+			err: "Invalid settings: WSUpgrader.ReadBufferSize is negative",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway, err := NewGatewayWithValidation(tt.settings)
+			if tt.err == "" {
+				assert.NilError(t, err)
+				assert.Assert(t, gateway != nil)
+			} else {
+				assert.Error(t, err, tt.err)
+			}
+		})
+	}
+}
+
+// newTestGateway starts a Gateway in a httptest server. Its NATS connections
+// are in-memory pipes served by natsServer
+func newTestGateway(t testing.TB, settings Settings, natsServer func(net.Conn)) *httptest.Server {
+	t.Helper()
+	_, server := startTestGateway(t, settings, natsServer)
+	return server
+}
+
+// startTestGateway is newTestGateway, also returning the Gateway
+func startTestGateway(t testing.TB, settings Settings, natsServer func(net.Conn)) (*Gateway, *httptest.Server) {
+	t.Helper()
+	settings.NatsAddr = "nats:4222"
+	if settings.ErrorHandler == nil {
+		settings.ErrorHandler = func(error) {}
+	}
+	if settings.Logger == nil {
+		settings.Logger = WriterLogger{W: io.Discard}
+	}
+	settings.Dialer = func(network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			natsServer(server)
+		}()
+		return client, nil
+	}
+	gateway := NewGateway(settings)
+	server := httptest.NewServer(http.HandlerFunc(gateway.Handler))
+	t.Cleanup(server.Close)
+	return gateway, server
+}
+
+// dialTestGateway opens a websocket to a gateway started by newTestGateway
+func dialTestGateway(t *testing.T, server *httptest.Server) *websocket.Conn {
+	t.Helper()
+	wsConn, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.NilError(t, err)
+	t.Cleanup(func() { wsConn.Close() })
+	return wsConn
+}
+
+func readWSMessage(t *testing.T, wsConn *websocket.Conn) string {
+	t.Helper()
+	wsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := wsConn.ReadMessage()
+	assert.NilError(t, err)
+	return string(data)
+}
+
+func TestMaxPayload(t *testing.T) {
+	received := make(chan string, 10)
+	server := newTestGateway(t, Settings{}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {\"max_payload\":4}\r\n"))
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- line
+		}
+	})
+	wsConn := dialTestGateway(t, server)
+
+	assert.Equal(t, "INFO {\"max_payload\":4}\r\n", readWSMessage(t, wsConn))
+
+	assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte("PUB foo 4\r\n1234\r\n")))
+	assert.Equal(t, "PUB foo 4\r\n", <-received)
+	assert.Equal(t, "1234\r\n", <-received)
+
+	assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte("PUB foo 5\r\n12345\r\n")))
+	assert.Equal(t, "-ERR 'Maximum Payload Violation'\r\n", readWSMessage(t, wsConn))
+	_, ok := <-received
+	assert.Assert(t, !ok, "the NATS connection should be closed")
+}
+
+func TestUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "nats.sock")
+	listener, err := net.Listen("unix", sock)
+	assert.NilError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("INFO {}\r\n"))
+		conn.Read(make([]byte, 1))
+	}()
+
+	gateway := NewGateway(Settings{
+		NatsAddr:     sock,
+		NatsNetwork:  "unix",
+		ErrorHandler: func(error) {},
+	})
+	server := httptest.NewServer(http.HandlerFunc(gateway.Handler))
+	defer server.Close()
+	wsConn := dialTestGateway(t, server)
+
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+}
+
+func TestOutboundQueue(t *testing.T) {
+	server := newTestGateway(t, Settings{OutboundQueueSize: 2}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+		for i := 0; i < 5; i++ {
+			conn.Write([]byte("PING\r\n"))
+		}
+		conn.Read(make([]byte, 1))
+	})
+	wsConn := dialTestGateway(t, server)
+
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, "PING\r\n", readWSMessage(t, wsConn))
+	}
+}
+
+func TestOutboundDropOldest(t *testing.T) {
+	msg := func(subject string) string { return "MSG " + subject + " 1 1\r\nx\r\n" }
+	stalled := make(chan struct{})
+	queued := make(chan struct{})
+	stats := make(chan *ConnStats, 1)
+	var once sync.Once
+	server := newTestGateway(t, Settings{
+		HandlePing:         true,
+		OutboundQueueSize:  2,
+		OutboundDropOldest: true,
+		// the websocket writes stall on the first MSG, until all the others
+		// are queued
+		OnFrame: func(dir string, data []byte) {
+			if dir == DirNatsToWS && strings.HasPrefix(string(data), "MSG") {
+				once.Do(func() {
+					close(stalled)
+					<-queued
+				})
+			}
+		},
+		OnConnClose: func(s *ConnStats) { stats <- s },
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n" + msg("a")))
+		<-stalled
+		for _, subject := range []string{"b", "c", "d", "e"} {
+			conn.Write([]byte(msg(subject)))
+		}
+		// the PONG tells that all the messages went through the queue
+		conn.Write([]byte("PING\r\n"))
+		reader := bufio.NewReader(conn)
+		line, _ := reader.ReadString('\n')
+		assert.Equal(t, "PONG\r\n", line)
+		close(queued)
+		reader.ReadString('\n')
+	})
+	wsConn := dialTestGateway(t, server)
+
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+	// b and c were dropped to make room for d and e
+	for _, subject := range []string{"a", "d", "e"} {
+		assert.Equal(t, msg(subject), readWSMessage(t, wsConn))
+	}
+	wsConn.Close()
+	assert.Equal(t, int64(2), (<-stats).DroppedNatsToWS.Load())
+}
+
+func TestBatchWindow(t *testing.T) {
+	commands := []string{"MSG a 1 2\r\nhi\r\n", "PING\r\n", "MSG b 1 3\r\nyou\r\n"}
+	for _, tt := range []struct {
+		name     string
+		maxBytes int
+		messages int
+	}{
+		{"batched", 0, 1},
+		{"max bytes", 16, 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestGateway(t, Settings{
+				BatchWindow:   100 * time.Millisecond,
+				BatchMaxBytes: tt.maxBytes,
+			}, func(conn net.Conn) {
+				conn.Write([]byte("INFO {}\r\n" + strings.Join(commands, "")))
+				conn.Read(make([]byte, 1))
+			})
+			wsConn := dialTestGateway(t, server)
+			assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+
+			var received bytes.Buffer
+			for i := 0; i < tt.messages; i++ {
+				received.WriteString(readWSMessage(t, wsConn))
+			}
+			reader := NewCommandsReader(&received)
+			for _, expected := range commands {
+				cmd, err := reader.NextCommand()
+				assert.NilError(t, err)
+				assert.Equal(t, expected, string(cmd))
+			}
+			_, err := reader.NextCommand()
+			assert.Equal(t, io.EOF, err)
+		})
+	}
+}
+
+func TestForwardPartial(t *testing.T) {
+	rest := make(chan struct{})
+	server := newTestGateway(t, Settings{ForwardPartial: true}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\nMSG test 1 10\r\n01234"))
+		<-rest
+		conn.Write([]byte("56789\r\n"))
+		conn.Read(make([]byte, 1))
+	})
+	wsConn := dialTestGateway(t, server)
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+
+	assert.Equal(t, "MSG test 1 10\r\n01234", readWSMessage(t, wsConn))
+	close(rest)
+	assert.Equal(t, "56789\r\n", readWSMessage(t, wsConn))
+}
+
+func TestOutboundFilter(t *testing.T) {
+	server := newTestGateway(t, Settings{
+		OutboundFilter: func(cmd []byte) ([]byte, bool) {
+			if bytes.HasPrefix(cmd, []byte("MSG secret ")) {
+				return nil, false
+			}
+			return bytes.Replace(cmd, []byte("tenant1."), nil, 1), true
+		},
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n" +
+			"MSG secret 1 2\r\nhi\r\n" +
+			"MSG tenant1.test 2 5\r\nhello\r\n"))
+		conn.Read(make([]byte, 1))
+	})
+	wsConn := dialTestGateway(t, server)
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+	assert.Equal(t, "MSG test 2 5\r\nhello\r\n", readWSMessage(t, wsConn))
+}
+
+// stuckConn is a connection whose writes block forever, even once closed
+type stuckConn struct {
+	net.Conn
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (c stuckConn) Write(b []byte) (int, error) {
+	close(c.writing)
+	<-c.release
+	return 0, io.ErrClosedPipe
+}
+
+func TestDrainTimeout(t *testing.T) {
+	logger := &testLogger{}
+	writing, release, exit := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	defer close(release)
+	closed := make(chan struct{})
+	gateway := NewGateway(Settings{
+		NatsAddr:     "nats:4222",
+		ErrorHandler: func(error) {},
+		Logger:       logger,
+		DrainTimeout: 50 * time.Millisecond,
+		OnConnClose:  func(*ConnStats) { close(closed) },
+		Dialer: func(network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				server.Write([]byte("INFO {}\r\n"))
+				<-exit
+			}()
+			return stuckConn{Conn: client, writing: writing, release: release}, nil
+		},
+	})
+	server := httptest.NewServer(http.HandlerFunc(gateway.Handler))
+	defer server.Close()
+	wsConn := dialTestGateway(t, server)
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+
+	wsConn.WriteMessage(websocket.TextMessage, []byte("PUB foo 2\r\nhi\r\n"))
+	<-writing
+	// the NATS server leaves, the websocket to NATS worker stays stuck
+	close(exit)
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler did not return")
+	}
+	var warned bool
+	for _, warn := range logger.Warns() {
+		warned = warned || strings.Contains(warn, "did not stop within 50ms")
+	}
+	assert.Assert(t, warned, "warnings: %q", logger.Warns())
+}
+
+func TestConnErrorReportedOnce(t *testing.T) {
+	var mu sync.Mutex
+	var errs []error
+	closed := make(chan struct{})
+	server := newTestGateway(t, Settings{
+		IdleTimeout: 10 * time.Millisecond,
+		ErrorHandler: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		},
+		OnConnClose: func(*ConnStats) { close(closed) },
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+		conn.Read(make([]byte, 1))
+	})
+	wsConn := dialTestGateway(t, server)
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+
+	<-closed
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, len(errs))
+	assert.Assert(t, errors.Is(errs[0], ErrIdleTimeout))
+	connErr, ok := errs[0].(*ConnError)
+	assert.Assert(t, ok)
+	assert.Equal(t, 16, len(connErr.ID))
+}
+
+func TestDisconnect(t *testing.T) {
+	var errs, disconnects []error
+	closed := make(chan struct{})
+	server := newTestGateway(t, Settings{
+		ErrorHandler: func(err error) { errs = append(errs, err) },
+		OnDisconnect: func(err error) { disconnects = append(disconnects, err) },
+		OnConnClose:  func(*ConnStats) { close(closed) },
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+		conn.Read(make([]byte, 1))
+	})
+	wsConn := dialTestGateway(t, server)
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+
+	wsConn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, "bye"))
+	<-closed
+
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, 1, len(disconnects))
+	assert.Assert(t, websocket.IsCloseError(disconnects[0], websocket.CloseGoingAway))
+}
+
+func TestConnectCloseEvents(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		server    string
+		err       string
+		closeCode int
+	}{
+		{"client close", "", "", websocket.CloseGoingAway},
+		{"connection lost", "", "", websocket.CloseAbnormalClosure},
+		{"server error", "-ERR 'Authorization Violation'\r\n", "NATS server error: Authorization Violation", 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var opened *NatsConn
+			closed := make(chan error, 1)
+			var closeCode int
+			var closeText string
+			server := newTestGateway(t, Settings{
+				OnConnect: func(r *http.Request, natsConn *NatsConn) { opened = natsConn },
+				OnClose: func(r *http.Request, natsConn *NatsConn, err error) {
+					assert.Equal(t, opened, natsConn)
+					closeCode, closeText = natsConn.ClientCloseCode, natsConn.ClientCloseText
+					closed <- err
+				},
+			}, func(conn net.Conn) {
+				conn.Write([]byte("INFO {}\r\n" + tt.server))
+				conn.Read(make([]byte, 1))
+			})
+			wsConn := dialTestGateway(t, server)
+			assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+			if tt.closeCode == websocket.CloseGoingAway {
+				wsConn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "navigating"))
+			} else if tt.closeCode == websocket.CloseAbnormalClosure {
+				wsConn.UnderlyingConn().Close()
+			}
+
+			err := <-closed
+			if tt.closeCode == websocket.CloseGoingAway {
+				assert.Equal(t, "navigating", closeText)
+			}
+			if tt.err == "" {
+				assert.NilError(t, err)
+			} else {
+				assert.Error(t, err, tt.err)
+			}
+			assert.Equal(t, tt.closeCode, closeCode)
+		})
+	}
+}
+
+func TestConnStatsBytes(t *testing.T) {
+	const msg, pub = "MSG foo 1 2\r\nhi\r\n", "PUB foo 5\r\nhello\r\n"
+	for name, info := range map[string]string{
+		"raw":    "INFO {\"headers\":true}\r\n",
+		"framed": "INFO {\"max_payload\":1024}\r\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			natsServer, received := newRecordingNatsServer(info + msg)
+			stats := make(chan *ConnStats, 1)
+			server := newTestGateway(t, Settings{
+				OnConnClose: func(s *ConnStats) { stats <- s },
+			}, natsServer)
+			wsConn := dialTestGateway(t, server)
+			readWSMessage(t, wsConn)
+			assert.Equal(t, msg, readWSMessage(t, wsConn))
+			assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte(pub)))
+			<-received
+			<-received
+			wsConn.Close()
+
+			s := <-stats
+			// the INFO is not counted
+			assert.Equal(t, int64(len(msg)), s.BytesNatsToWS.Load())
+			assert.Equal(t, int64(len(pub)), s.BytesWSToNats.Load())
+		})
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	server := newTestGateway(t, Settings{MaxConnections: 2}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+		conn.Read(make([]byte, 1))
+	})
+	for i := 0; i < 2; i++ {
+		wsConn := dialTestGateway(t, server)
+		assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestActiveConnections(t *testing.T) {
+	connected := make(chan struct{}, 2)
+	gateway, server := startTestGateway(t, Settings{
+		OnConnect: func(*http.Request, *NatsConn) { connected <- struct{}{} },
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+		conn.Read(make([]byte, 1))
+	})
+	assert.Equal(t, 0, gateway.ActiveConnections())
+
+	var wsConns []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		wsConns = append(wsConns, dialTestGateway(t, server))
+		<-connected
+	}
+	assert.Equal(t, 2, gateway.ActiveConnections())
+
+	wsConns[0].Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for gateway.ActiveConnections() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, gateway.ActiveConnections())
+}
+
+func TestHealthy(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		info string
+		err  string
+	}{
+		{"ok", "INFO {}\r\n", ""},
+		{"invalid info", "PING\r\n", `Invalid 'INFO' command: "PING\r\n"`},
+		{"invalid info json", "INFO {\r\n", "Invalid 'INFO' json"},
+		{"no info", "", "i/o timeout"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway, _ := startTestGateway(t, Settings{}, func(conn net.Conn) {
+				conn.Write([]byte(tt.info))
+				conn.Read(make([]byte, 1))
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			err := gateway.Healthy(ctx)
+			if tt.err == "" {
+				assert.NilError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.err)
+			}
+			if strings.HasPrefix(tt.err, "Invalid 'INFO'") {
+				assert.Assert(t, errors.Is(err, ErrInvalidInfo))
+			}
+		})
+	}
+}
+
+func TestReadInfo(t *testing.T) {
+	for _, tt := range []struct {
+		cmd  string
+		info string
+		ok   bool
+	}{
+		{"", "", false},
+		{"IN", "", false},
+		{"INFO", "", false},
+		{"INFO\r\n", "", false},
+		{"INFO {}", "", false},
+		{"INFO {}\n", "", false},
+		{"INFO {} \n", "", false},
+		{"INFO {}\r", "", false},
+		{"PING\r\n", "", false},
+		{"INFO \r\n", "", true},
+		{"INFO {}\r\n", "{}", true},
+		{"INFO {} \t \r\n", "{}", true},
+		{"INFO  {}\r\n", "{}", true},
+	} {
+		info, err := readInfo([]byte(tt.cmd))
+		if tt.ok {
+			assert.NilError(t, err)
+			assert.Equal(t, NatsServerInfo(tt.info), info)
+		} else {
+			assert.Assert(t, errors.Is(err, ErrInvalidInfo), "%q: %v", tt.cmd, err)
+		}
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	gateway := NewGateway(Settings{
+		NatsAddr: "nats:4222",
+		Dialer: func(network, addr string) (net.Conn, error) {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: os.ErrDeadlineExceeded}
+		},
+	})
+	err := gateway.Healthy(context.Background())
+	assert.Assert(t, errors.Is(err, ErrNatsDial))
+	var netErr net.Error
+	assert.Assert(t, errors.As(err, &netErr) && netErr.Timeout())
+
+	err = fmt.Errorf("wrapped: %w", &MaxPayloadError{Size: 2, MaxPayload: 1})
+	assert.Assert(t, errors.Is(err, ErrMaxPayload))
+	assert.Error(t, err, "wrapped: Maximum payload violation: 2 > 1")
+}
+
+func TestHandlePing(t *testing.T) {
+	pong := make(chan string, 1)
+	var stats *ConnStats
+	closed := make(chan struct{})
+	server := newTestGateway(t, Settings{
+		HandlePing:  true,
+		OnConnClose: func(s *ConnStats) { stats = s; close(closed) },
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\nPING\r\n"))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		pong <- line
+		conn.Write([]byte("-ERR 'test'\r\n"))
+	})
+	wsConn := dialTestGateway(t, server)
+
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+	assert.Equal(t, "PONG\r\n", <-pong)
+	assert.Equal(t, "-ERR 'test'\r\n", readWSMessage(t, wsConn))
+	<-closed
+	assert.Equal(t, int64(1), stats.AutoPongs.Load())
+}
+
+func TestRespondToWSPing(t *testing.T) {
+	closed := make(chan struct{})
+	server := newTestGateway(t, Settings{
+		RespondToWSPing: true,
+		IdleTimeout:     200 * time.Millisecond,
+		OnConnClose:     func(*ConnStats) { close(closed) },
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+		conn.Read(make([]byte, 1))
+	})
+	wsConn := dialTestGateway(t, server)
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+
+	pongs := make(chan string, 10)
+	wsConn.SetPongHandler(func(data string) error {
+		pongs <- data
+		return nil
+	})
+	go wsConn.ReadMessage()
+
+	for i := 0; i < 5; i++ {
+		assert.NilError(t, wsConn.WriteControl(
+			websocket.PingMessage, []byte("ping"), time.Now().Add(time.Second)))
+		assert.Equal(t, "ping", <-pongs)
+		time.Sleep(100 * time.Millisecond)
+	}
+	select {
+	case <-closed:
+		t.Fatal("the pings should keep the connection alive")
+	default:
+	}
+}
+
+func TestWSPingInterval(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		answer bool
+	}{
+		{"alive", true},
+		{"dead", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := make(chan error, 1)
+			natsServer, received := newRecordingNatsServer("INFO {}\r\n")
+			server := newTestGateway(t, Settings{
+				WSPingInterval: 20 * time.Millisecond,
+				WSPongTimeout:  50 * time.Millisecond,
+				ErrorHandler:   func(err error) { errs <- err },
+			}, natsServer)
+			wsConn := dialTestGateway(t, server)
+			assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+
+			var pings atomic.Int32
+			wsConn.SetPingHandler(func(data string) error {
+				pings.Add(1)
+				if !tt.answer {
+					return nil
+				}
+				return wsConn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+			})
+			readErr := make(chan error, 1)
+			go func() {
+				_, _, err := wsConn.ReadMessage()
+				readErr <- err
+			}()
+
+			if !tt.answer {
+				err := <-readErr
+				assert.Assert(t, websocket.IsCloseError(err, websocket.CloseInternalServerErr), "%v", err)
+				assert.Assert(t, errors.Is(<-errs, ErrWSPongTimeout))
+				assert.Equal(t, int32(1), pings.Load())
+				return
+			}
+			time.Sleep(200 * time.Millisecond)
+			assert.Assert(t, pings.Load() >= 3, "%d pings", pings.Load())
+			assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte("SUB foo 1\r\n")))
+			assert.Equal(t, "SUB foo 1\r\n", <-received)
+		})
+	}
+}
+
+func TestVerboseRelay(t *testing.T) {
+	server := newTestGateway(t, Settings{}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n+OK\r\n+OK\r\n-ERR 'Unknown Protocol Operation'\r\n"))
+		conn.Read(make([]byte, 1))
+	})
+	wsConn := dialTestGateway(t, server)
+
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+	assert.Equal(t, "+OK\r\n", readWSMessage(t, wsConn))
+	assert.Equal(t, "+OK\r\n", readWSMessage(t, wsConn))
+	assert.Equal(t, "-ERR 'Unknown Protocol Operation'\r\n", readWSMessage(t, wsConn))
+}
+
+func TestServerErrCloseCode(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		err       string
+		closeCode int
+	}{
+		{"authorization", "-ERR 'Authorization Violation'\r\n", websocket.ClosePolicyViolation},
+		{"max payload", "-ERR 'Maximum Payload Violation'\r\n", websocket.CloseMessageTooBig},
+		{"other", "-ERR 'Stale Connection'\r\n", websocket.CloseInternalServerErr},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestGateway(t, Settings{}, func(conn net.Conn) {
+				conn.Write([]byte("INFO {}\r\n-ERR 'Permissions Violation for Publish to \"foo\"'\r\n"))
+				conn.Write([]byte(tt.err))
+				conn.Read(make([]byte, 1))
+			})
+			wsConn := dialTestGateway(t, server)
+
+			assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+			assert.Equal(t, "-ERR 'Permissions Violation for Publish to \"foo\"'\r\n",
+				readWSMessage(t, wsConn))
+			assert.Equal(t, tt.err, readWSMessage(t, wsConn))
+			_, _, err := wsConn.ReadMessage()
+			assert.Assert(t, websocket.IsCloseError(err, tt.closeCode), err)
+		})
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	errs := make(chan error, 1)
+	gateway := NewGateway(Settings{
+		NatsAddr:     "nats:4222",
+		DialTimeout:  50 * time.Millisecond,
+		ErrorHandler: func(err error) { errs <- err },
+		Logger:       &testLogger{},
+		Dialer: func(network, addr string) (net.Conn, error) {
+			// a server that never answers
+			<-release
+			return nil, io.ErrClosedPipe
+		},
+	})
+	server := httptest.NewServer(http.HandlerFunc(gateway.Handler))
+	defer server.Close()
+	wsConn := dialTestGateway(t, server)
+
+	start := time.Now()
+	_, _, err := wsConn.ReadMessage()
+	assert.DeepEqual(t, &websocket.CloseError{
+		Code: websocket.CloseInternalServerErr,
+		Text: "NATS connection timeout",
+	}, err)
+	assert.Assert(t, time.Since(start) < time.Second)
+	err = <-errs
+	var netErr net.Error
+	assert.Assert(t, errors.As(err, &netErr) && netErr.Timeout(), "%v", err)
+	assert.Assert(t, errors.Is(err, ErrNatsDial), "%v", err)
+}
+
+func TestInfoReadTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	closed := make(chan struct{})
+	server := newTestGateway(t, Settings{
+		InfoReadTimeout: 50 * time.Millisecond,
+		ErrorHandler:    func(err error) { errs <- err },
+	}, func(conn net.Conn) {
+		// accept the connection but never send the INFO
+		conn.Read(make([]byte, 1))
+		close(closed)
+	})
+	wsConn := dialTestGateway(t, server)
+
+	start := time.Now()
+	_, _, err := wsConn.ReadMessage()
+	assert.DeepEqual(t, &websocket.CloseError{
+		Code: websocket.CloseInternalServerErr,
+		Text: "NATS connection timeout",
+	}, err)
+	assert.Assert(t, time.Since(start) < time.Second)
+	assert.Assert(t, errors.Is(<-errs, ErrInfoTimeout))
+	// the half-open connection is closed
+	<-closed
+}
+
+func TestMaxInfoSize(t *testing.T) {
+	errs := make(chan error, 1)
+	server := newTestGateway(t, Settings{
+		MaxInfoSize:  64,
+		ErrorHandler: func(err error) { errs <- err },
+	}, func(conn net.Conn) {
+		// an endless INFO line
+		conn.Write([]byte("INFO {\"connect_urls\":[" + strings.Repeat("\"10.0.0.1:4222\",", 1000)))
+		conn.Read(make([]byte, 1))
+	})
+	wsConn := dialTestGateway(t, server)
+
+	_, _, err := wsConn.ReadMessage()
+	assert.DeepEqual(t, &websocket.CloseError{
+		Code: websocket.CloseInternalServerErr,
+		Text: "NATS connection failed",
+	}, err)
+	err = <-errs
+	assert.Assert(t, errors.Is(err, ErrInfoTooLarge), "%v", err)
+	var tooLarge *CommandTooLargeError
+	assert.Assert(t, errors.As(err, &tooLarge))
+	assert.Equal(t, 64, tooLarge.MaxCommandSize)
+}
+
+func TestInfoSplitWrites(t *testing.T) {
+	const info = "INFO {\"server_id\":\"test\",\"max_payload\":1024}\r\n"
+	server := newTestGateway(t, Settings{}, func(conn net.Conn) {
+		// one TCP segment per byte
+		for i := range info {
+			conn.Write([]byte{info[i]})
+		}
+		conn.Read(make([]byte, 1))
+	})
+	wsConn := dialTestGateway(t, server)
+	assert.Equal(t, info, readWSMessage(t, wsConn))
+}
+
+func TestUpstreamClosed(t *testing.T) {
+	server := newTestGateway(t, Settings{}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+	})
+	wsConn := dialTestGateway(t, server)
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+
+	_, _, err := wsConn.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	assert.Assert(t, ok, "unexpected error: %v", err)
+	assert.Equal(t, websocket.CloseInternalServerErr, closeErr.Code)
+	assert.Equal(t, "upstream NATS closed", closeErr.Text)
+}
+
+func TestCloseMessageFunc(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		fn       func(error) (int, string)
+		expected *websocket.CloseError
+	}{
+		{"default", nil, &websocket.CloseError{Code: websocket.CloseInternalServerErr, Text: "internal error"}},
+		{"custom", func(err error) (int, string) {
+			if errors.Is(err, ErrMaxPayload) {
+				return websocket.CloseMessageTooBig, "payload too big"
+			}
+			return websocket.CloseInternalServerErr, err.Error()
+		}, &websocket.CloseError{Code: websocket.CloseMessageTooBig, Text: "payload too big"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestGateway(t, Settings{CloseMessageFunc: tt.fn}, func(conn net.Conn) {
+				conn.Write([]byte("INFO {\"max_payload\":4}\r\n"))
+				conn.Read(make([]byte, 1))
+			})
+			wsConn := dialTestGateway(t, server)
+			readWSMessage(t, wsConn)
+
+			assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte("PUB foo 5\r\nhello\r\n")))
+			assert.Equal(t, "-ERR 'Maximum Payload Violation'\r\n", readWSMessage(t, wsConn))
+			_, _, err := wsConn.ReadMessage()
+			assert.DeepEqual(t, tt.expected, err)
+		})
+	}
+}
+
+func TestConnectRetries(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		failures int
+		status   int
+	}{
+		{"recovered", 2, http.StatusSwitchingProtocols},
+		{"exhausted", 3, http.StatusServiceUnavailable},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var dials int
+			gateway := NewGateway(Settings{
+				NatsAddr:       "nats:4222",
+				ErrorHandler:   func(error) {},
+				ConnectRetries: 2,
+				ConnectBackoff: time.Millisecond,
+				Dialer: func(network, addr string) (net.Conn, error) {
+					dials++
+					if dials <= tt.failures {
+						return nil, fmt.Errorf("connection refused")
+					}
+					client, server := net.Pipe()
+					go func() {
+						defer server.Close()
+						server.Write([]byte("INFO {}\r\n"))
+						server.Read(make([]byte, 1))
+					}()
+					return client, nil
+				},
+			})
+			server := httptest.NewServer(http.HandlerFunc(gateway.Handler))
+			defer server.Close()
+
+			wsConn, resp, err := websocket.DefaultDialer.Dial(
+				"ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			assert.Equal(t, tt.status, resp.StatusCode)
+			if err == nil {
+				wsConn.Close()
+			}
+			assert.Equal(t, 3, dials)
+		})
+	}
+}
+
+func TestNatsConnClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	natsConn := &NatsConn{Conn: client, CmdReader: NewCommandsReader(client)}
+
+	assert.NilError(t, natsConn.Close())
+	assert.NilError(t, natsConn.Close())
+	_, err := client.Write([]byte("PING\r\n"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+}
+
+func TestRequestContextCancel(t *testing.T) {
+	disconnected := make(chan error, 1)
+	gateway := NewGateway(Settings{
+		NatsAddr:     "nats:4222",
+		OnDisconnect: func(err error) { disconnected <- err },
+		Dialer: func(network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				server.Write([]byte("INFO {}\r\n"))
+				server.Read(make([]byte, 1))
+			}()
+			return client, nil
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	server := httptest.NewUnstartedServer(http.HandlerFunc(gateway.Handler))
+	server.Config.BaseContext = func(net.Listener) context.Context { return ctx }
+	server.Start()
+	defer server.Close()
+	wsConn := dialTestGateway(t, server)
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+
+	cancel()
+
+	assert.Equal(t, context.Canceled, <-disconnected)
+	_, _, err := wsConn.ReadMessage()
+	assert.Assert(t, err != nil)
+}
+
+func TestSubprotocols(t *testing.T) {
+	subprotocol := make(chan string, 1)
+	server := newTestGateway(t, Settings{
+		Subprotocols: []string{"nats", "nats-binary"},
+		ConnectHandler: func(natsConn *NatsConn, r *http.Request, wsConn *websocket.Conn) error {
+			subprotocol <- natsConn.Subprotocol
+			return nil
+		},
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+		conn.Read(make([]byte, 1))
+	})
+	dialer := websocket.Dialer{Subprotocols: []string{"other", "nats-binary"}}
+	wsConn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.NilError(t, err)
+	defer wsConn.Close()
+
+	assert.Equal(t, "nats-binary", wsConn.Subprotocol())
+	assert.Equal(t, "nats-binary", <-subprotocol)
+}
+
+func TestUpgradeRequired(t *testing.T) {
+	gateway := NewGateway(Settings{NatsAddr: "localhost:4222", ErrorHandler: func(error) {}})
+
+	r := httptest.NewRequest("GET", "/nats", nil)
+	r.ProtoMajor, r.ProtoMinor, r.Proto = 2, 0, "HTTP/2.0"
+	rec := httptest.NewRecorder()
+	gateway.Handler(rec, r)
+	assert.Equal(t, http.StatusUpgradeRequired, rec.Code)
+	assert.Equal(t, "websocket", rec.Header().Get("Upgrade"))
+	assert.Assert(t, strings.Contains(rec.Body.String(), "websocket requires HTTP/1.1, got HTTP/2.0"))
+
+	// the upgrade headers were dropped
+	rec = httptest.NewRecorder()
+	gateway.Handler(rec, httptest.NewRequest("GET", "/nats", nil))
+	assert.Equal(t, http.StatusUpgradeRequired, rec.Code)
+	assert.Assert(t, strings.Contains(rec.Body.String(), "'Upgrade: websocket'"))
+}
+
+func TestResponseHeader(t *testing.T) {
+	server := newTestGateway(t, Settings{
+		ResponseHeader: func(r *http.Request) http.Header {
+			return http.Header{
+				"X-Correlation-Id":       {"42"},
+				"Sec-Websocket-Protocol": {r.Header.Get("Sec-Websocket-Protocol")},
+			}
+		},
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+		conn.Read(make([]byte, 1))
+	})
+	dialer := websocket.Dialer{Subprotocols: []string{"nats"}}
+	wsConn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.NilError(t, err)
+	defer wsConn.Close()
+	assert.Equal(t, "42", resp.Header.Get("X-Correlation-Id"))
+	assert.Equal(t, "nats", wsConn.Subprotocol())
+}
+
+func TestWSBufferSizes(t *testing.T) {
+	payload := strings.Repeat("x", 100*1024)
+	msg := fmt.Sprintf("MSG foo 1 %d\r\n%s\r\n", len(payload), payload)
+	for name, settings := range map[string]Settings{
+		"sized":  {WSReadBufferSize: 64 * 1024, WSWriteBufferSize: 64 * 1024},
+		"reused": {WSReuseServerBuffers: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			natsServer, received := newRecordingNatsServer("INFO {}\r\n" + msg)
+			server := newTestGateway(t, settings, natsServer)
+			wsConn := dialTestGateway(t, server)
+			assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+			assert.Equal(t, msg, readWSMessage(t, wsConn))
+
+			assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage,
+				[]byte(fmt.Sprintf("PUB foo %d\r\n%s\r\n", len(payload), payload))))
+			assert.Equal(t, fmt.Sprintf("PUB foo %d\r\n", len(payload)), <-received)
+			assert.Equal(t, payload+"\r\n", <-received)
+		})
+	}
+}
+
+func TestPreUpgrade(t *testing.T) {
+	var dials atomic.Int32
+	server := newTestGateway(t, Settings{
+		PreUpgrade: func(w http.ResponseWriter, r *http.Request) bool {
+			if _, err := r.Cookie("session"); err != nil {
+				http.Error(w, "not logged in", http.StatusUnauthorized)
+				return false
+			}
+			return true
+		},
+	}, func(conn net.Conn) {
+		dials.Add(1)
+		conn.Write([]byte("INFO {}\r\n"))
+		conn.Read(make([]byte, 1))
+	})
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, int32(0), dials.Load())
+
+	wsConn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Cookie": {"session=abc"}})
+	assert.NilError(t, err)
+	defer wsConn.Close()
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+}
+
+func TestReadMessage(t *testing.T) {
+	// the buffer is used if the message fits, and grown otherwise
+	buf := make([]byte, 64)
+	data, err := readMessage(strings.NewReader("PUB foo 3\r\nbar\r\n"), buf)
+	assert.NilError(t, err)
+	assert.Equal(t, "PUB foo 3\r\nbar\r\n", string(data))
+	assert.Equal(t, &buf[0], &data[0])
+
+	data, err = readMessage(iotest.OneByteReader(strings.NewReader("PUB foo 10\r\n0123456789\r\n")), make([]byte, 4))
+	assert.NilError(t, err)
+	assert.Equal(t, "PUB foo 10\r\n0123456789\r\n", string(data))
+}
+
+func TestStalledClientMessage(t *testing.T) {
+	fragmentSent := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	server := newTestGateway(t, Settings{HandlePing: true}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {\"headers\":true}\r\n"))
+		<-fragmentSent
+		go io.Copy(io.Discard, conn)
+		conn.Write([]byte("PING\r\nMSG foo 1 2\r\nhi\r\n"))
+		<-done
+	})
+	dialer := websocket.Dialer{WriteBufferSize: 1024}
+	wsConn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.NilError(t, err)
+	defer wsConn.Close()
+	assert.Equal(t, "INFO {\"headers\":true}\r\n", readWSMessage(t, wsConn))
+
+	// the first fragments of a message that is never finished
+	w, err := wsConn.NextWriter(websocket.TextMessage)
+	assert.NilError(t, err)
+	_, err = w.Write([]byte("PUB foo 100000\r\n" + strings.Repeat("x", 4096)))
+	assert.NilError(t, err)
+	close(fragmentSent)
+
+	// the gateway PONG, and thus the NATS messages, are not blocked
+	assert.Equal(t, "MSG foo 1 2\r\nhi\r\n", readWSMessage(t, wsConn))
+}
+
+func TestOnFrame(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		info string
+	}{
+		{"raw", "INFO {\"headers\":true}\r\n"},
+		{"framed", "INFO {\"max_payload\":1024}\r\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := make(chan string, 10)
+			natsServer := func(conn net.Conn) {
+				conn.Write([]byte(tt.info + "MSG foo 1 2\r\nhi\r\n"))
+				conn.Read(make([]byte, 1024))
+				conn.Read(make([]byte, 1))
+			}
+			server := newTestGateway(t, Settings{
+				OnFrame: func(dir string, data []byte) { frames <- dir + " " + string(data) },
+			}, natsServer)
+			wsConn := dialTestGateway(t, server)
+			readWSMessage(t, wsConn)
+			readWSMessage(t, wsConn)
+			assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte("SUB foo 1\r\n")))
+
+			assert.Equal(t, DirNatsToWS+" "+tt.info, <-frames)
+			assert.Equal(t, DirNatsToWS+" MSG foo 1 2\r\nhi\r\n", <-frames)
+			assert.Equal(t, DirWSToNats+" SUB foo 1\r\n", <-frames)
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package gw
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsStreamReader reads the successive websocket messages as a single stream
+type wsStreamReader struct {
+	ws  *websocket.Conn
+	cur io.Reader
+	// err is the websocket read error, once the stream failed
+	err error
+}
+
+func (r *wsStreamReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			_, cur, err := r.ws.NextReader()
+			if err != nil {
+				r.err = err
+				return 0, err
+			}
+			r.cur = cur
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		if err != nil {
+			r.err = err
+		}
+		return n, err
+	}
+}
+
+// inboundFraming tells if an inbound policy is enabled, the client commands
+// being then parsed by wsToNatsCommands instead of being copied as is to
+// NATS. The max_payload advertised by the server is one of them, and so are
+// the rejection of the HPUB by a server without the headers support, and the
+// capture of the CONNECT, which must see every client CONNECT
+func (gw *Gateway) inboundFraming(pair *connPair) bool {
+	return pair.natsConn.Info.MaxPayload > 0 ||
+		!pair.natsConn.Info.Headers ||
+		gw.capturesConnect() ||
+		gw.settings.AuthorizeSubject != nil ||
+		gw.settings.ReadOnly ||
+		gw.settings.WriteOnly ||
+		gw.settings.SubjectMapper != nil ||
+		gw.settings.SubjectMetrics != nil ||
+		pair.messages != nil ||
+		pair.subs != nil
+}
+
+// capturesConnect tells if the client CONNECTs must be inspected, which
+// requires the framing of all the client commands
+func (gw *Gateway) capturesConnect() bool {
+	return gw.settings.OnClientConnect != nil ||
+		gw.settings.ConnectRewriter != nil ||
+		gw.settings.GatewayManagedConnect
+}
+
+// maxControlLine returns Settings.MaxControlLine or its default
+func (gw *Gateway) maxControlLine() int {
+	if gw.settings.MaxControlLine <= 0 {
+		return defaultMaxControlLine
+	}
+	return gw.settings.MaxControlLine
+}
+
+// captureConnect records the first client CONNECT in NatsConn.ClientConnect,
+// and passes every client CONNECT to OnClientConnect
+func (gw *Gateway) captureConnect(pair *connPair, cmd []byte) error {
+	options := append([]byte(nil), bytes.TrimSpace(cmd[len("CONNECT "):])...)
+	if pair.natsConn.ClientConnect == nil {
+		pair.natsConn.ClientConnect = options
+	}
+	if gw.settings.OnClientConnect != nil {
+		return gw.settings.OnClientConnect(pair.request, options)
+	}
+	return nil
+}
+
+// clientConnect applies the GatewayManagedConnect mode and the
+// ConnectRewriter to a client CONNECT. It returns nil if the CONNECT must be
+// dropped
+func (gw *Gateway) clientConnect(cmd []byte) ([]byte, error) {
+	if gw.settings.GatewayManagedConnect {
+		// the gateway already authenticated the connection
+		return nil, nil
+	}
+	if gw.settings.ConnectRewriter != nil {
+		return gw.rewriteConnect(cmd)
+	}
+	return cmd, nil
+}
+
+// wsToNatsCommands forwards the websocket stream to NATS command by command,
+// framed by a CommandsReader. It rejects any PUB whose payload exceeds the
+// server max_payload or does not match its declared size, and any HPUB if
+// the server does not support the headers. It captures the client CONNECTs,
+// drops them in the GatewayManagedConnect mode, drops the PUB and HPUB in the
+// ReadOnly mode and the SUB and UNSUB in the WriteOnly mode, and applies the
+// OnClientConnect, ConnectRewriter, AuthorizeSubject, SubjectMapper and
+// SubjectMetrics hooks. The websocket messages are a stream, like the NATS
+// connection: a command, or its payload, may span several messages, so a
+// payload shorter than declared at the end of a message is completed by the
+// next one
+func (gw *Gateway) wsToNatsCommands(messageType int, pair *connPair) {
+	maxPayload := pair.natsConn.Info.MaxPayload
+	if maxPayload <= 0 {
+		// the payloads are read in memory, they must be bounded anyway
+		maxPayload = int64(gw.maxCommandSize())
+	}
+	stream := &wsStreamReader{ws: pair.wsConn.Conn}
+	src := newClientCommandsReader(stream, gw.maxControlLine(), maxPayload)
+	// subject of each subscription id, for authorizing the UNSUBs
+	subs := make(map[string]string)
+	for {
+		cmd, err := src.NextCommand()
+		if err != nil {
+			var maxPayloadErr *MaxPayloadError
+			switch {
+			case stream.err != nil:
+				// the websocket read failed, err may only wrap it
+				err = stream.err
+			case err == ErrMaxControlLine:
+				pair.wsConn.WriteMessage(messageType, []byte("-ERR 'Maximum Control Line Exceeded'\r\n"))
+			case errors.As(err, &maxPayloadErr):
+				pair.wsConn.WriteMessage(messageType, []byte("-ERR 'Maximum Payload Violation'\r\n"))
+			case errors.Is(err, ErrMissingCRLF):
+				// not forwarding it, NATS would drop the connection
+				// with no explanation
+				pair.wsConn.WriteMessage(messageType, []byte("-ERR 'Invalid Publish'\r\n"))
+			default:
+				pair.wsConn.WriteMessage(messageType, []byte("-ERR 'Unknown Protocol Operation'\r\n"))
+			}
+			gw.connError(pair, err)
+			return
+		}
+		op, args := splitCommand(controlLine(cmd))
+		switch op {
+		case "HPUB":
+			if !pair.natsConn.Info.Headers {
+				// the servers with proto 0, and the first ones with
+				// proto 1, do not advertise the headers support
+				pair.wsConn.WriteMessage(messageType, []byte("-ERR 'Headers Not Supported'\r\n"))
+				gw.onError(&ConnError{ID: pair.id, Err: ErrHeadersNotSupported})
+				continue
+			}
+		case "CONNECT":
+			if err := gw.captureConnect(pair, cmd); err != nil {
+				gw.connError(pair, err)
+				return
+			}
+			if cmd, err = gw.clientConnect(cmd); err != nil {
+				gw.connError(pair, err)
+				return
+			}
+			if cmd == nil {
+				continue
+			}
+		}
+		if !gw.modeAllows(op) {
+			permErr := &PermissionError{Op: op}
+			if len(args) > 0 {
+				permErr.Subject = subjectOf(subs, op, args)
+			}
+			pair.wsConn.WriteMessage(messageType, []byte(permErr.natsErr()))
+			gw.onError(&ConnError{ID: pair.id, Err: permErr})
+			continue
+		}
+		if gw.settings.AuthorizeSubject != nil {
+			allowed, err := gw.authorizeCommand(pair, subs, op, args)
+			if err != nil {
+				pair.wsConn.WriteMessage(messageType, []byte("-ERR 'Unknown Protocol Operation'\r\n"))
+				gw.connError(pair, err)
+				return
+			}
+			if !allowed {
+				permErr := &PermissionError{Op: op, Subject: subjectOf(subs, op, args)}
+				pair.wsConn.WriteMessage(messageType, []byte(permErr.natsErr()))
+				gw.onError(&ConnError{ID: pair.id, Err: permErr})
+				continue
+			}
+		}
+		if pair.messages != nil && (op == "PUB" || op == "HPUB") && !gw.throttle(messageType, pair) {
+			continue
+		}
+		if gw.settings.SubjectMetrics != nil && len(args) > 0 &&
+			(op == "PUB" || op == "HPUB" || op == "SUB") {
+			gw.settings.SubjectMetrics(DirWSToNats, string(args[0]))
+		}
+		if gw.settings.SubjectMapper != nil {
+			cmd = mapSubjects(cmd, gw.settings.SubjectMapper.MapOutgoing)
+		}
+		gw.observe(pair, DirWSToNats, cmd)
+		if pair.bytes != nil && !pair.paceBytes(len(cmd)) {
+			gw.connError(pair, net.ErrClosed)
+			return
+		}
+		n, err := pair.natsConn.write(cmd)
+		pair.stats.BytesWSToNats.Add(int64(n))
+		gw.metrics.AddBytes(DirWSToNats, int64(n))
+		if err != nil {
+			gw.connError(pair, err)
+			return
+		}
+		if pair.subs != nil {
+			trackSubscription(pair.subs, op, args)
+		}
+	}
+}
+
+// throttle applies Settings.MaxMessagesPerSecond to a client message. It
+// returns false if the message must be dropped
+func (gw *Gateway) throttle(messageType int, pair *connPair) bool {
+	if gw.settings.DropThrottled {
+		if pair.messages.take(time.Now(), 1) {
+			return true
+		}
+		pair.stats.ThrottledWSToNats.Add(1)
+		pair.wsConn.WriteMessage(messageType, []byte("-ERR 'Message Rate Exceeded'\r\n"))
+		return false
+	}
+	wait := pair.messages.reserve(time.Now(), 1)
+	if wait > 0 {
+		pair.stats.ThrottledWSToNats.Add(1)
+	}
+	return pair.wait(wait)
+}
+
+// controlLine returns the control line of a command, without its payload
+func controlLine(cmd []byte) []byte {
+	if end := bytes.IndexByte(cmd, '\n'); end >= 0 {
+		return cmd[:end+1]
+	}
+	return cmd
+}
+
+// trackSubscription keeps the set of the client subscription ids up to date
+func trackSubscription(subs map[string]struct{}, op string, args [][]byte) {
+	switch {
+	case op == "SUB" && len(args) >= 2:
+		subs[string(args[len(args)-1])] = struct{}{}
+	case op == "UNSUB" && len(args) == 1:
+		delete(subs, string(args[0]))
+	}
+}
+
+// rewriteConnect applies the ConnectRewriter to a CONNECT command
+func (gw *Gateway) rewriteConnect(cmd []byte) ([]byte, error) {
+	options := bytes.TrimSpace(cmd[len("CONNECT "):])
+	options, err := gw.settings.ConnectRewriter(options)
+	if err != nil {
+		return nil, fmt.Errorf("Error rewriting CONNECT: %w", err)
+	}
+	cmd = append([]byte("CONNECT "), options...)
+	return append(cmd, '\r', '\n'), nil
+}
+
+// subjectOf returns the subject a PUB, HPUB, SUB or UNSUB applies to
+func subjectOf(subs map[string]string, op string, args [][]byte) string {
+	switch op {
+	case "PUB", "HPUB", "SUB":
+		return string(args[0])
+	case "UNSUB":
+		return subs[string(args[0])]
+	}
+	return ""
+}
+
+// modeAllows tells if the ReadOnly and WriteOnly modes allow a client
+// operation
+func (gw *Gateway) modeAllows(op string) bool {
+	switch op {
+	case "PUB", "HPUB":
+		return !gw.settings.ReadOnly
+	case "SUB", "UNSUB":
+		return !gw.settings.WriteOnly
+	}
+	return true
+}
+
+// authorizeCommand checks a client command against AuthorizeSubject. An error
+// is returned if the command is malformed
+func (gw *Gateway) authorizeCommand(pair *connPair, subs map[string]string, op string, args [][]byte) (bool, error) {
+	var minArgs, maxArgs int
+	switch op {
+	case "PUB", "SUB":
+		minArgs, maxArgs = 2, 3
+	case "HPUB":
+		minArgs, maxArgs = 3, 4
+	case "UNSUB":
+		minArgs, maxArgs = 1, 2
+	default:
+		return true, nil
+	}
+	if len(args) < minArgs || len(args) > maxArgs {
+		return false, fmt.Errorf("Invalid %s command: %d arguments", op, len(args))
+	}
+	if op == "UNSUB" {
+		subject, ok := subs[string(args[0])]
+		if !ok {
+			// not a subscription of ours, harmless
+			return true, nil
+		}
+		allowed := gw.settings.AuthorizeSubject(pair.request, op, subject)
+		if allowed {
+			delete(subs, string(args[0]))
+		}
+		return allowed, nil
+	}
+	subject := string(args[0])
+	allowed := gw.settings.AuthorizeSubject(pair.request, op, subject)
+	if allowed && op == "SUB" {
+		subs[string(args[len(args)-1])] = subject
+	}
+	return allowed, nil
+}
@@ -0,0 +1,378 @@
+package gw
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"gotest.tools/assert"
+)
+
+// newRecordingNatsServer returns a fake NATS server sending info, then
+// pushing the lines it receives to a channel
+func newRecordingNatsServer(info string) (func(net.Conn), chan string) {
+	received := make(chan string, 100)
+	return func(conn net.Conn) {
+		conn.Write([]byte(info))
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			received <- line
+		}
+	}, received
+}
+
+func TestAuthorizeSubject(t *testing.T) {
+	natsServer, received := newRecordingNatsServer("INFO {}\r\n")
+	server := newTestGateway(t, Settings{
+		AuthorizeSubject: func(req *http.Request, op string, subject string) bool {
+			return strings.HasPrefix(subject, "tenant.")
+		},
+	}, natsServer)
+	wsConn := dialTestGateway(t, server)
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+
+	send := func(cmd string) {
+		assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte(cmd)))
+	}
+
+	send("SUB tenant.foo 1\r\n")
+	assert.Equal(t, "SUB tenant.foo 1\r\n", <-received)
+
+	send("SUB other.foo 2\r\n")
+	assert.Equal(t,
+		"-ERR 'Permissions Violation for Subscription to \"other.foo\"'\r\n",
+		readWSMessage(t, wsConn))
+
+	send("PUB other.foo 5\r\nhello\r\n")
+	assert.Equal(t,
+		"-ERR 'Permissions Violation for Publish to \"other.foo\"'\r\n",
+		readWSMessage(t, wsConn))
+
+	send("PUB tenant.foo 5\r\nhello\r\nUNSUB 1\r\n")
+	assert.Equal(t, "PUB tenant.foo 5\r\n", <-received)
+	assert.Equal(t, "hello\r\n", <-received)
+	assert.Equal(t, "UNSUB 1\r\n", <-received)
+
+	send("SUB\r\n")
+	assert.Equal(t, "-ERR 'Unknown Protocol Operation'\r\n", readWSMessage(t, wsConn))
+}
+
+func TestReadOnly(t *testing.T) {
+	natsServer, received := newRecordingNatsServer("INFO {\"headers\":true}\r\n")
+	errs := make(chan error, 2)
+	server := newTestGateway(t, Settings{
+		ReadOnly:     true,
+		ErrorHandler: func(err error) { errs <- err },
+	}, natsServer)
+	wsConn := dialTestGateway(t, server)
+	readWSMessage(t, wsConn)
+
+	send := func(cmd string) {
+		assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte(cmd)))
+	}
+	send("PUB foo 5\r\nhello\r\n")
+	assert.Equal(t, "-ERR 'Permissions Violation for Publish to \"foo\"'\r\n", readWSMessage(t, wsConn))
+	send("HPUB foo 12 14\r\nNATS/1.0\r\n\r\nhi\r\n")
+	assert.Equal(t, "-ERR 'Permissions Violation for Publish to \"foo\"'\r\n", readWSMessage(t, wsConn))
+	for i := 0; i < 2; i++ {
+		var permErr *PermissionError
+		assert.Assert(t, errors.As(<-errs, &permErr))
+	}
+
+	send("SUB foo 1\r\nPING\r\nUNSUB 1\r\n")
+	assert.Equal(t, "SUB foo 1\r\n", <-received)
+	assert.Equal(t, "PING\r\n", <-received)
+	assert.Equal(t, "UNSUB 1\r\n", <-received)
+}
+
+func TestWriteOnly(t *testing.T) {
+	natsServer, received := newRecordingNatsServer("INFO {}\r\n")
+	errs := make(chan error, 2)
+	server := newTestGateway(t, Settings{
+		WriteOnly:    true,
+		ErrorHandler: func(err error) { errs <- err },
+	}, natsServer)
+	wsConn := dialTestGateway(t, server)
+	readWSMessage(t, wsConn)
+
+	send := func(cmd string) {
+		assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte(cmd)))
+	}
+	send("SUB foo 1\r\n")
+	assert.Equal(t, "-ERR 'Permissions Violation for Subscription to \"foo\"'\r\n", readWSMessage(t, wsConn))
+	send("UNSUB 1\r\n")
+	assert.Equal(t, "-ERR 'Permissions Violation for Subscription to \"\"'\r\n", readWSMessage(t, wsConn))
+	for i := 0; i < 2; i++ {
+		var permErr *PermissionError
+		assert.Assert(t, errors.As(<-errs, &permErr))
+	}
+
+	send("PUB foo 5\r\nhello\r\n")
+	assert.Equal(t, "PUB foo 5\r\n", <-received)
+	assert.Equal(t, "hello\r\n", <-received)
+}
+
+func TestHeadersRoundTrip(t *testing.T) {
+	const hmsg = "HMSG foo 1 26 28\r\nNATS/1.0\r\nA: 1\r\nB: two\r\n\r\nhi\r\n"
+	const hpub = "HPUB foo 26 28\r\nNATS/1.0\r\nA: 1\r\nB: two\r\n\r\nhi\r\n"
+	received := make(chan string, 1)
+	server := newTestGateway(t, Settings{}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {\"max_payload\":1024,\"headers\":true}\r\n"))
+		conn.Write([]byte(hmsg))
+		cmd, err := NewCommandsReader(conn).NextCommand()
+		if err == nil {
+			received <- string(cmd)
+		}
+	})
+	wsConn := dialTestGateway(t, server)
+
+	readWSMessage(t, wsConn)
+	assert.Equal(t, hmsg, readWSMessage(t, wsConn))
+
+	assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte(hpub)))
+	assert.Equal(t, hpub, <-received)
+}
+
+func TestHeadersNotSupported(t *testing.T) {
+	for name, info := range map[string]string{
+		// the headers support alone makes the gateway parse the commands
+		"no max_payload": "INFO {\"proto\":0}\r\n",
+		"max_payload":    "INFO {\"max_payload\":1024,\"proto\":0}\r\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			natsServer, received := newRecordingNatsServer(info)
+			errs := make(chan error, 1)
+			server := newTestGateway(t, Settings{ErrorHandler: func(err error) { errs <- err }}, natsServer)
+			wsConn := dialTestGateway(t, server)
+			readWSMessage(t, wsConn)
+
+			assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte(
+				"HPUB foo 12 14\r\nNATS/1.0\r\n\r\nhi\r\nPUB foo 2\r\nhi\r\n")))
+			assert.Equal(t, "-ERR 'Headers Not Supported'\r\n", readWSMessage(t, wsConn))
+			assert.Assert(t, errors.Is(<-errs, ErrHeadersNotSupported))
+			// the connection is kept
+			assert.Equal(t, "PUB foo 2\r\n", <-received)
+		})
+	}
+}
+
+func TestPayloadSizeBounded(t *testing.T) {
+	// without a max_payload, the payloads are bounded by MaxCommandSize
+	natsServer, _ := newRecordingNatsServer("INFO {}\r\n")
+	errs := make(chan error, 1)
+	server := newTestGateway(t, Settings{
+		MaxCommandSize:   1024,
+		AuthorizeSubject: func(*http.Request, string, string) bool { return true },
+		ErrorHandler:     func(err error) { errs <- err },
+	}, natsServer)
+	wsConn := dialTestGateway(t, server)
+	readWSMessage(t, wsConn)
+
+	assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte("PUB a 9223372036854775807\r\n")))
+	assert.Equal(t, "-ERR 'Maximum Payload Violation'\r\n", readWSMessage(t, wsConn))
+	assert.Assert(t, errors.Is(<-errs, ErrMaxPayload))
+}
+
+func TestMaxControlLine(t *testing.T) {
+	natsServer, received := newRecordingNatsServer("INFO {\"max_payload\":1024}\r\n")
+	errs := make(chan error, 1)
+	server := newTestGateway(t, Settings{
+		MaxControlLine: 64,
+		ErrorHandler:   func(err error) { errs <- err },
+	}, natsServer)
+	wsConn := dialTestGateway(t, server)
+	readWSMessage(t, wsConn)
+
+	assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte("SUB foo 1\r\n")))
+	assert.Equal(t, "SUB foo 1\r\n", <-received)
+	// a line without '\n' is not buffered beyond the limit
+	for i := 0; i < 2; i++ {
+		assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 40))))
+	}
+	assert.Equal(t, "-ERR 'Maximum Control Line Exceeded'\r\n", readWSMessage(t, wsConn))
+	assert.Assert(t, errors.Is(<-errs, ErrMaxControlLine))
+}
+
+func TestMaxWSMessageSize(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		settings Settings
+		info     string
+		size     int
+		payload  int
+	}{
+		{"setting", Settings{MaxWSMessageSize: 100}, "INFO {}\r\n", 100, 50},
+		{"max_payload", Settings{MaxControlLine: 64}, "INFO {\"max_payload\":100}\r\n", 100 + 64 + 2, 100},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			natsServer, received := newRecordingNatsServer(tt.info)
+			errs := make(chan error, 1)
+			tt.settings.ErrorHandler = func(err error) { errs <- err }
+			server := newTestGateway(t, tt.settings, natsServer)
+			wsConn := dialTestGateway(t, server)
+			readWSMessage(t, wsConn)
+
+			// a message of the maximum size goes through
+			ctrlLen := tt.size - tt.payload - 2
+			subject := strings.Repeat("a", ctrlLen-len(fmt.Sprintf("PUB  %d\r\n", tt.payload)))
+			ctrl := fmt.Sprintf("PUB %s %d\r\n", subject, tt.payload)
+			payload := strings.Repeat("x", tt.payload) + "\r\n"
+			assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte(ctrl+payload)))
+			assert.Equal(t, ctrl, <-received)
+			assert.Equal(t, payload, <-received)
+
+			assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", tt.size+1))))
+			_, _, err := wsConn.ReadMessage()
+			assert.Assert(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), "%v", err)
+			assert.Assert(t, errors.Is(<-errs, ErrWSMessageTooLarge))
+		})
+	}
+}
+
+func TestOnClientConnect(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		info string
+	}{
+		{"no max_payload", "INFO {}\r\n"},
+		{"max_payload", "INFO {\"max_payload\":1024}\r\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			natsServer, received := newRecordingNatsServer(tt.info)
+			connects := make(chan string, 2)
+			closed := make(chan string, 1)
+			server := newTestGateway(t, Settings{
+				OnClientConnect: func(req *http.Request, options []byte) error {
+					connects <- string(options)
+					return nil
+				},
+				OnClose: func(r *http.Request, natsConn *NatsConn, err error) {
+					closed <- string(natsConn.ClientConnect)
+				},
+			}, natsServer)
+			wsConn := dialTestGateway(t, server)
+			readWSMessage(t, wsConn)
+
+			send := func(cmd string) {
+				assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte(cmd)))
+			}
+			// the CONNECT is split across messages, and followed by
+			// other commands
+			send("CONNECT {\"verbose\"")
+			send(":false}\r\nPING\r\nSUB foo")
+			send(" 1\r\nCONNECT {\"verbose\":true}\r\n")
+			assert.Equal(t, "CONNECT {\"verbose\":false}\r\n", <-received)
+			assert.Equal(t, "PING\r\n", <-received)
+			assert.Equal(t, "SUB foo 1\r\n", <-received)
+			assert.Equal(t, "CONNECT {\"verbose\":true}\r\n", <-received)
+			// every CONNECT is seen, the first one is kept
+			assert.Equal(t, "{\"verbose\":false}", <-connects)
+			assert.Equal(t, "{\"verbose\":true}", <-connects)
+
+			wsConn.Close()
+			assert.Equal(t, "{\"verbose\":false}", <-closed)
+		})
+	}
+}
+
+func TestOnClientConnectRejected(t *testing.T) {
+	natsServer, received := newRecordingNatsServer("INFO {}\r\n")
+	server := newTestGateway(t, Settings{
+		OnClientConnect: func(req *http.Request, options []byte) error {
+			if strings.Contains(string(options), "\"user\":\"admin\"") {
+				return fmt.Errorf("%w: admin", ErrAuthorization)
+			}
+			return nil
+		},
+	}, natsServer)
+	wsConn := dialTestGateway(t, server)
+	readWSMessage(t, wsConn)
+
+	assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage,
+		[]byte("CONNECT {\"user\":\"admin\"}\r\nPING\r\n")))
+	_, _, err := wsConn.ReadMessage()
+	assert.Assert(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+	assert.Equal(t, 0, len(received))
+}
+
+func TestInboundCommandsFraming(t *testing.T) {
+	natsServer, received := newRecordingNatsServer("INFO {\"max_payload\":1024}\r\n")
+	errs := make(chan error, 1)
+	server := newTestGateway(t, Settings{ErrorHandler: func(err error) { errs <- err }}, natsServer)
+	wsConn := dialTestGateway(t, server)
+	readWSMessage(t, wsConn)
+
+	send := func(cmd string) {
+		assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte(cmd)))
+	}
+	// a payload looking like commands, and commands split across messages
+	send("PUB foo 11\r\nSUB x 1\r\n\r\n\r\nSU")
+	send("B foo 1\r\nPING\r")
+	send("\n")
+	for _, expected := range []string{"PUB foo 11\r\n", "SUB x 1\r\n", "\r\n", "\r\n", "SUB foo 1\r\n", "PING\r\n"} {
+		assert.Equal(t, expected, <-received)
+	}
+
+	send("PUB foo x\r\n")
+	assert.Equal(t, "-ERR 'Unknown Protocol Operation'\r\n", readWSMessage(t, wsConn))
+	assert.Assert(t, <-errs != nil)
+}
+
+func TestInvalidPublish(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cmd  string
+	}{
+		{"payload longer than declared", "PUB foo 2\r\nhello\r\n"},
+		{"payload shorter than declared", "PUB foo 10\r\nhello\r\nPING\r\n"},
+		{"headers payload longer than declared", "HPUB foo 12 14\r\nNATS/1.0\r\n\r\nhello\r\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			natsServer, received := newRecordingNatsServer("INFO {\"max_payload\":1024,\"headers\":true}\r\n")
+			errs := make(chan error, 1)
+			server := newTestGateway(t, Settings{
+				DefaultMode:  BinaryMode,
+				ErrorHandler: func(err error) { errs <- err },
+			}, natsServer)
+			wsConn := dialTestGateway(t, server)
+			readWSMessage(t, wsConn)
+
+			assert.NilError(t, wsConn.WriteMessage(websocket.BinaryMessage, []byte("PUB foo 2\r\nhi\r\n")))
+			assert.Equal(t, "PUB foo 2\r\n", <-received)
+			assert.Equal(t, "hi\r\n", <-received)
+
+			assert.NilError(t, wsConn.WriteMessage(websocket.BinaryMessage, []byte(tt.cmd)))
+			messageType, msg, err := wsConn.ReadMessage()
+			assert.NilError(t, err)
+			assert.Equal(t, websocket.BinaryMessage, messageType)
+			assert.Equal(t, "-ERR 'Invalid Publish'\r\n", string(msg))
+			assert.Assert(t, errors.Is(<-errs, ErrMissingCRLF))
+			// nothing of the malformed command reached NATS
+			assert.Equal(t, 0, len(received))
+		})
+	}
+}
+
+func TestPublishSpanningMessages(t *testing.T) {
+	natsServer, received := newRecordingNatsServer("INFO {\"max_payload\":1024}\r\n")
+	server := newTestGateway(t, Settings{}, natsServer)
+	wsConn := dialTestGateway(t, server)
+	readWSMessage(t, wsConn)
+
+	// a payload shorter than declared, alone in its message, is completed by
+	// the next message
+	assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte("PUB foo 5\r\nhel")))
+	assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte("lo\r\nPING\r\n")))
+	assert.Equal(t, "PUB foo 5\r\n", <-received)
+	assert.Equal(t, "hello\r\n", <-received)
+	assert.Equal(t, "PING\r\n", <-received)
+}
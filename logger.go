@@ -0,0 +1,66 @@
+package gw
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Logger is used in Settings for the gateway logs
+type Logger interface {
+	// Tracef logs the traffic, only called when Settings.Trace is set
+	Tracef(format string, args ...interface{})
+	// Warnf logs a warning
+	Warnf(format string, args ...interface{})
+	// Errorf logs an error
+	Errorf(format string, args ...interface{})
+}
+
+// WriterLogger is a Logger writing plain text lines to an io.Writer
+type WriterLogger struct {
+	W io.Writer
+}
+
+// Tracef implements Logger
+func (l WriterLogger) Tracef(format string, args ...interface{}) {
+	fmt.Fprintln(l.W, "[TRACE]", fmt.Sprintf(format, args...))
+}
+
+// Warnf implements Logger
+func (l WriterLogger) Warnf(format string, args ...interface{}) {
+	fmt.Fprintln(l.W, "[WARN]", fmt.Sprintf(format, args...))
+}
+
+// Errorf implements Logger
+func (l WriterLogger) Errorf(format string, args ...interface{}) {
+	fmt.Fprintln(l.W, "[ERROR]", fmt.Sprintf(format, args...))
+}
+
+var defaultLogger = WriterLogger{W: os.Stderr}
+
+// connLogger prefixes the messages with the correlation id of a connection
+type connLogger struct {
+	Logger
+	id string
+}
+
+func (l connLogger) Tracef(format string, args ...interface{}) {
+	l.Logger.Tracef("[%s] %s", l.id, fmt.Sprintf(format, args...))
+}
+
+func (l connLogger) Warnf(format string, args ...interface{}) {
+	l.Logger.Warnf("[%s] %s", l.id, fmt.Sprintf(format, args...))
+}
+
+func (l connLogger) Errorf(format string, args ...interface{}) {
+	l.Logger.Errorf("[%s] %s", l.id, fmt.Sprintf(format, args...))
+}
+
+// newConnID returns a random connection correlation id
+func newConnID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,62 @@
+package gw
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+type testLogger struct {
+	mu     sync.Mutex
+	traces []string
+	warns  []string
+}
+
+func (l *testLogger) Tracef(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.traces = append(l.traces, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Warnf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warns = append(l.warns, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Errorf(format string, args ...interface{}) {}
+
+func (l *testLogger) Traces() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.traces...)
+}
+
+func (l *testLogger) Warns() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.warns...)
+}
+
+func TestTraceLogger(t *testing.T) {
+	logger := &testLogger{}
+	ids := make(chan string, 1)
+	server := newTestGateway(t, Settings{
+		Trace:     true,
+		Logger:    logger,
+		OnConnect: func(r *http.Request, natsConn *NatsConn) { ids <- natsConn.ID },
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+		conn.Read(make([]byte, 1))
+	})
+	wsConn := dialTestGateway(t, server)
+
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+	id := <-ids
+	assert.Equal(t, 16, len(id))
+	assert.DeepEqual(t, []string{"[" + id + "] <-- INFO {}\r\n"}, logger.Traces())
+}
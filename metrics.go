@@ -0,0 +1,72 @@
+package gw
+
+import "bytes"
+
+// Directions of the data flowing through the gateway, as passed to
+// Metrics.AddBytes
+const (
+	DirNatsToWS = "nats_to_ws"
+	DirWSToNats = "ws_to_nats"
+)
+
+// Metrics collects the gateway activity. It is used in Settings
+type Metrics interface {
+	// IncConnections is called when a websocket <-> NATS pair is established
+	IncConnections()
+	// DecConnections is called when a websocket <-> NATS pair is torn down
+	DecConnections()
+	// AddBytes is called when n bytes were forwarded in the dir direction
+	AddBytes(dir string, n int64)
+	// IncErrors is called for each error reported to the ErrorHandler
+	IncErrors()
+}
+
+// TLSMetrics is optionally implemented by a Metrics
+type TLSMetrics interface {
+	// IncTLSConnections is called when a websocket <-> NATS pair whose
+	// NATS connection is encrypted is established, along with
+	// IncConnections
+	IncTLSConnections()
+}
+
+// CompressionMetrics is optionally implemented by a Metrics
+type CompressionMetrics interface {
+	// IncConnectionsByCompression is called when a websocket <-> NATS pair
+	// is established, along with IncConnections, telling if the client
+	// negotiated the permessage-deflate compression
+	IncConnectionsByCompression(compressed bool)
+}
+
+// NoopMetrics is a Metrics that does nothing. It is the default
+type NoopMetrics struct{}
+
+// IncConnections implements Metrics
+func (NoopMetrics) IncConnections() {}
+
+// DecConnections implements Metrics
+func (NoopMetrics) DecConnections() {}
+
+// AddBytes implements Metrics
+func (NoopMetrics) AddBytes(dir string, n int64) {}
+
+// IncErrors implements Metrics
+func (NoopMetrics) IncErrors() {}
+
+// IncTLSConnections implements TLSMetrics
+func (NoopMetrics) IncTLSConnections() {}
+
+// IncConnectionsByCompression implements CompressionMetrics
+func (NoopMetrics) IncConnectionsByCompression(compressed bool) {}
+
+// msgSubject returns the subject of a MSG or HMSG command
+func msgSubject(cmd []byte) (string, bool) {
+	end := bytes.Index(cmd, []byte("\r\n"))
+	if end < 0 {
+		return "", false
+	}
+	op, args := splitCommand(cmd[:end])
+	if (op != "MSG" && op != "HMSG") || len(args) == 0 {
+		return "", false
+	}
+	return string(args[0]), true
+}
@@ -0,0 +1,126 @@
+package gw
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gotest.tools/assert"
+)
+
+// fakeMetrics records the Metrics calls
+type fakeMetrics struct {
+	mu          sync.Mutex
+	connections int
+	opened      int
+	bytes       map[string]int64
+	errors      int
+	tls         int
+	compressed  int
+}
+
+func (m *fakeMetrics) IncConnections() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connections++
+	m.opened++
+}
+
+func (m *fakeMetrics) DecConnections() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connections--
+}
+
+func (m *fakeMetrics) AddBytes(dir string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes[dir] += n
+}
+
+func (m *fakeMetrics) IncErrors() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors++
+}
+
+func (m *fakeMetrics) IncTLSConnections() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tls++
+}
+
+func (m *fakeMetrics) IncConnectionsByCompression(compressed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if compressed {
+		m.compressed++
+	}
+}
+
+func (m *fakeMetrics) snapshot() fakeMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bytes := make(map[string]int64)
+	for dir, n := range m.bytes {
+		bytes[dir] = n
+	}
+	return fakeMetrics{connections: m.connections, opened: m.opened, bytes: bytes, errors: m.errors, tls: m.tls,
+		compressed: m.compressed}
+}
+
+func TestMetrics(t *testing.T) {
+	const msg, pub = "MSG foo 1 2\r\nhi\r\n", "PUB foo 2\r\nhi\r\n"
+	metrics := &fakeMetrics{bytes: make(map[string]int64)}
+	received := make(chan struct{})
+	server := newTestGateway(t, Settings{Metrics: metrics}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n" + msg))
+		NewCommandsReader(conn).NextCommand()
+		close(received)
+		conn.Write([]byte("-ERR 'Authorization Violation'\r\n"))
+		conn.Read(make([]byte, 1))
+	})
+	wsConn := dialTestGateway(t, server)
+	readWSMessage(t, wsConn)
+	assert.Equal(t, msg, readWSMessage(t, wsConn))
+	assert.Equal(t, 1, metrics.snapshot().connections)
+
+	assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte(pub)))
+	<-received
+
+	// the -ERR tears the pair down
+	deadline := time.Now().Add(5 * time.Second)
+	for metrics.snapshot().connections != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	snapshot := metrics.snapshot()
+	assert.Equal(t, 0, snapshot.connections)
+	assert.Equal(t, 1, snapshot.opened)
+	assert.Equal(t, 1, snapshot.errors)
+	assert.Equal(t, int64(len(msg)+len("-ERR 'Authorization Violation'\r\n")), snapshot.bytes[DirNatsToWS])
+	assert.Equal(t, int64(len(pub)), snapshot.bytes[DirWSToNats])
+}
+
+func TestSubjectMetrics(t *testing.T) {
+	subjects := make(chan string, 10)
+	natsServer, received := newRecordingNatsServer("INFO {\"headers\":true}\r\nMSG _INBOX.abc 1 2\r\nhi\r\n")
+	server := newTestGateway(t, Settings{
+		SubjectMetrics: func(dir, subject string) { subjects <- dir + " " + subject },
+	}, natsServer)
+	wsConn := dialTestGateway(t, server)
+	readWSMessage(t, wsConn)
+	readWSMessage(t, wsConn)
+	assert.Equal(t, DirNatsToWS+" _INBOX.abc", <-subjects)
+
+	assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage,
+		[]byte("SUB foo 1\r\nPUB bar 2\r\nhi\r\nHPUB baz 12 14\r\nNATS/1.0\r\n\r\nhi\r\nUNSUB 1\r\n")))
+	for i := 0; i < 8; i++ {
+		<-received
+	}
+	assert.Equal(t, DirWSToNats+" foo", <-subjects)
+	assert.Equal(t, DirWSToNats+" bar", <-subjects)
+	assert.Equal(t, DirWSToNats+" baz", <-subjects)
+	assert.Equal(t, 0, len(subjects))
+}
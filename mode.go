@@ -0,0 +1,45 @@
+package gw
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// Mode is the type of the websocket messages carrying the NATS commands
+type Mode int
+
+// The available modes
+const (
+	TextMode   Mode = websocket.TextMessage
+	BinaryMode Mode = websocket.BinaryMessage
+)
+
+// connMode returns the mode of a connection. In order of precedence, it is
+// given by:
+//
+//   - the 'mode' query parameter: 'text' or 'binary'. Any other value is
+//     an error
+//   - the negotiated subprotocol, if found in Settings.SubprotocolModes
+//   - Settings.DefaultMode, TextMode if not set
+func (gw *Gateway) connMode(r *http.Request, subprotocol string) (Mode, error) {
+	if value, ok := r.URL.Query()["mode"]; ok {
+		if len(value) == 1 {
+			switch value[0] {
+			case "text":
+				return TextMode, nil
+			case "binary":
+				return BinaryMode, nil
+			}
+		}
+		return 0, fmt.Errorf("Invalid mode %q, expected 'text' or 'binary'", value)
+	}
+	if mode, ok := gw.settings.SubprotocolModes[subprotocol]; ok && subprotocol != "" {
+		return mode, nil
+	}
+	if gw.settings.DefaultMode != 0 {
+		return gw.settings.DefaultMode, nil
+	}
+	return TextMode, nil
+}
@@ -0,0 +1,59 @@
+package gw
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"gotest.tools/assert"
+)
+
+func TestConnMode(t *testing.T) {
+	gateway := NewGateway(Settings{
+		NatsAddr:         "localhost:4222",
+		SubprotocolModes: map[string]Mode{"nats-binary": BinaryMode, "nats": TextMode},
+		DefaultMode:      BinaryMode,
+	})
+	for _, tt := range []struct {
+		url         string
+		subprotocol string
+		mode        Mode
+	}{
+		{"/nats", "", BinaryMode},
+		{"/nats", "unknown", BinaryMode},
+		{"/nats", "nats", TextMode},
+		{"/nats", "nats-binary", BinaryMode},
+		{"/nats?mode=binary", "nats", BinaryMode},
+		{"/nats?mode=text", "nats-binary", TextMode},
+	} {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		mode, err := gateway.connMode(r, tt.subprotocol)
+		assert.NilError(t, err)
+		assert.Equal(t, tt.mode, mode, tt.url+" "+tt.subprotocol)
+	}
+
+	mode, err := NewGateway(Settings{}).connMode(httptest.NewRequest("GET", "/nats", nil), "")
+	assert.NilError(t, err)
+	assert.Equal(t, TextMode, mode)
+
+	for _, url := range []string{"/nats?mode=bniary", "/nats?mode=", "/nats?mode=text&mode=binary"} {
+		_, err := gateway.connMode(httptest.NewRequest("GET", url, nil), "")
+		assert.ErrorContains(t, err, "Invalid mode", url)
+	}
+}
+
+func TestInvalidModeClose(t *testing.T) {
+	server := newTestGateway(t, Settings{}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+	})
+	wsConn, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(server.URL, "http")+"?mode=bniary", nil)
+	assert.NilError(t, err)
+	defer wsConn.Close()
+
+	_, _, err = wsConn.ReadMessage()
+	assert.Assert(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), err)
+	assert.ErrorContains(t, err, `Invalid mode ["bniary"]`)
+}
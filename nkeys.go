@@ -0,0 +1,77 @@
+package gw
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+)
+
+// the nkeys prefix bytes, see github.com/nats-io/nkeys
+const (
+	nkeyPrefixSeed = 18 << 3
+	nkeyPrefixUser = 20 << 3
+)
+
+var nkeyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// nkey is an ed25519 key pair decoded from an nkey seed
+type nkey struct {
+	public  string
+	private ed25519.PrivateKey
+}
+
+// parseSeed decodes an nkey seed, like "SUA...", as found in the .nk and
+// .creds files
+func parseSeed(seed []byte) (*nkey, error) {
+	raw := make([]byte, nkeyEncoding.DecodedLen(len(bytes.TrimSpace(seed))))
+	n, err := nkeyEncoding.Decode(raw, bytes.TrimSpace(seed))
+	if err != nil {
+		return nil, ErrInvalidSeed
+	}
+	raw = raw[:n]
+	if len(raw) != 2+ed25519.SeedSize+2 {
+		return nil, ErrInvalidSeed
+	}
+	data, checksum := raw[:len(raw)-2], binary.LittleEndian.Uint16(raw[len(raw)-2:])
+	if crc16(data) != checksum || data[0]&0xf8 != nkeyPrefixSeed {
+		return nil, ErrInvalidSeed
+	}
+	// the type of the key is packed in the 3 low bits of the first byte
+	// and the 5 high bits of the second one
+	prefix := (data[0]&0x07)<<5 | (data[1]&0xf8)>>3
+	private := ed25519.NewKeyFromSeed(data[2:])
+	return &nkey{
+		public:  encodeNKey(prefix, private.Public().(ed25519.PublicKey)),
+		private: private,
+	}, nil
+}
+
+// encodeNKey encodes a public key with its type prefix and checksum
+func encodeNKey(prefix byte, key []byte) string {
+	data := append([]byte{prefix}, key...)
+	data = binary.LittleEndian.AppendUint16(data, crc16(data))
+	return nkeyEncoding.EncodeToString(data)
+}
+
+// sign signs a server nonce, encoding the signature like the NATS clients
+func (k *nkey) sign(nonce string) string {
+	return base64.RawURLEncoding.EncodeToString(ed25519.Sign(k.private, []byte(nonce)))
+}
+
+// crc16 is the CRC-16/XMODEM checksum of the nkeys
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
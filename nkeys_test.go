@@ -0,0 +1,55 @@
+package gw
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// encodeTestSeed encodes a raw ed25519 seed as an nkey user seed
+func encodeTestSeed(raw []byte) []byte {
+	data := []byte{nkeyPrefixSeed | nkeyPrefixUser>>5, (nkeyPrefixUser & 31) << 3}
+	data = append(data, raw...)
+	data = binary.LittleEndian.AppendUint16(data, crc16(data))
+	return []byte(nkeyEncoding.EncodeToString(data))
+}
+
+// verifyTestSig checks a CONNECT signature against an encoded public nkey
+func verifyTestSig(t *testing.T, public, nonce, sig string) {
+	t.Helper()
+	data, err := nkeyEncoding.DecodeString(public)
+	assert.NilError(t, err)
+	assert.Equal(t, byte(nkeyPrefixUser), data[0])
+	signature, err := base64.RawURLEncoding.DecodeString(sig)
+	assert.NilError(t, err)
+	assert.Assert(t, ed25519.Verify(ed25519.PublicKey(data[1:len(data)-2]), []byte(nonce), signature))
+}
+
+func TestCRC16(t *testing.T) {
+	// the CRC-16/XMODEM check value
+	assert.Equal(t, uint16(0x31c3), crc16([]byte("123456789")))
+}
+
+func TestParseSeed(t *testing.T) {
+	seed := encodeTestSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+	assert.Assert(t, bytes.HasPrefix(seed, []byte("SU")), "%s", seed)
+
+	key, err := parseSeed(append(seed, '\n'))
+	assert.NilError(t, err)
+	assert.Assert(t, key.public[0] == 'U', key.public)
+	verifyTestSig(t, key.public, "n0nce", key.sign("n0nce"))
+
+	for _, invalid := range [][]byte{
+		nil,
+		[]byte("not base32!"),
+		seed[:len(seed)-4],
+		append([]byte("SA"), seed[2:]...),
+	} {
+		_, err := parseSeed(invalid)
+		assert.Equal(t, ErrInvalidSeed, err, "%s", invalid)
+	}
+}
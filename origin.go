@@ -0,0 +1,25 @@
+package gw
+
+import (
+	"net/http"
+	"strings"
+)
+
+// AllowedOrigins returns a CheckOrigin function accepting the requests whose
+// Origin header is one of origins (e.g. "https://example.com"), compared
+// case-insensitively. The requests without an Origin header, which do not
+// come from a browser, are accepted
+func AllowedOrigins(origins ...string) func(*http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, allowed := range origins {
+			if strings.EqualFold(origin, allowed) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,53 @@
+package gw
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"gotest.tools/assert"
+)
+
+func TestAllowedOrigins(t *testing.T) {
+	check := AllowedOrigins("https://example.com", "http://localhost:8080")
+	for _, tt := range []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{"https://example.com", true},
+		{"https://EXAMPLE.com", true},
+		{"http://localhost:8080", true},
+		{"https://evil.com", false},
+		{"http://example.com", false},
+	} {
+		r := httptest.NewRequest("GET", "/nats", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		assert.Equal(t, tt.allowed, check(r), tt.origin)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	server := newTestGateway(t, Settings{
+		CheckOrigin: AllowedOrigins("https://example.com"),
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+		conn.Read(make([]byte, 1))
+	})
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	wsConn, _, err := websocket.DefaultDialer.Dial(url,
+		http.Header{"Origin": []string{"https://example.com"}})
+	assert.NilError(t, err)
+	wsConn.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial(url,
+		http.Header{"Origin": []string{"https://evil.com"}})
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
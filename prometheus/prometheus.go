@@ -0,0 +1,120 @@
+// Package prometheus provides a gw.Metrics implementation backed by
+// prometheus collectors. It lives in its own package so that the gw
+// package does not depend on the prometheus client
+package prometheus
+
+import (
+	"net/http"
+	"strconv"
+
+	gw "github.com/orus-io/nats-websocket-gw"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics implements gw.Metrics, prometheus.Collector and http.Handler
+type Metrics struct {
+	connections prom.Gauge
+	bytes       *prom.CounterVec
+	errors      prom.Counter
+	tls         prom.Counter
+	compression *prom.CounterVec
+
+	// handler serves the Metrics alone
+	handler http.Handler
+}
+
+var _ gw.Metrics = &Metrics{}
+var _ gw.TLSMetrics = &Metrics{}
+var _ gw.CompressionMetrics = &Metrics{}
+
+// NewMetrics creates a Metrics. The collectors are named after namespace,
+// and the Metrics must be registered to a prometheus registry
+func NewMetrics(namespace string) *Metrics {
+	m := &Metrics{
+		connections: prom.NewGauge(prom.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connections",
+			Help:      "Number of active websocket <-> NATS connections",
+		}),
+		bytes: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "bytes_total",
+			Help:      "Number of bytes forwarded, by direction",
+		}, []string{"dir"}),
+		errors: prom.NewCounter(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "errors_total",
+			Help:      "Number of errors",
+		}),
+		tls: prom.NewCounter(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "tls_connections_total",
+			Help:      "Number of websocket <-> NATS connections encrypted to NATS",
+		}),
+		compression: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "compression_connections_total",
+			Help:      "Number of websocket <-> NATS connections, by negotiated websocket compression",
+		}, []string{"compressed"}),
+	}
+	registry := prom.NewRegistry()
+	registry.MustRegister(m)
+	m.handler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	return m
+}
+
+// ServeHTTP serves the Metrics alone, for gw.Gateway.ServeMux. When they are
+// registered to a registry along with other collectors, serve that registry
+// with promhttp instead
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
+
+// IncConnections implements gw.Metrics
+func (m *Metrics) IncConnections() {
+	m.connections.Inc()
+}
+
+// DecConnections implements gw.Metrics
+func (m *Metrics) DecConnections() {
+	m.connections.Dec()
+}
+
+// AddBytes implements gw.Metrics
+func (m *Metrics) AddBytes(dir string, n int64) {
+	m.bytes.WithLabelValues(dir).Add(float64(n))
+}
+
+// IncErrors implements gw.Metrics
+func (m *Metrics) IncErrors() {
+	m.errors.Inc()
+}
+
+// IncTLSConnections implements gw.TLSMetrics
+func (m *Metrics) IncTLSConnections() {
+	m.tls.Inc()
+}
+
+// IncConnectionsByCompression implements gw.CompressionMetrics
+func (m *Metrics) IncConnectionsByCompression(compressed bool) {
+	m.compression.WithLabelValues(strconv.FormatBool(compressed)).Inc()
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prom.Desc) {
+	m.connections.Describe(ch)
+	m.bytes.Describe(ch)
+	m.errors.Describe(ch)
+	m.tls.Describe(ch)
+	m.compression.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prom.Metric) {
+	m.connections.Collect(ch)
+	m.bytes.Collect(ch)
+	m.errors.Collect(ch)
+	m.tls.Collect(ch)
+	m.compression.Collect(ch)
+}
@@ -0,0 +1,47 @@
+package prometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gw "github.com/orus-io/nats-websocket-gw"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics("natsgw")
+	metrics.IncConnections()
+	metrics.IncConnections()
+	metrics.DecConnections()
+	metrics.AddBytes(gw.DirNatsToWS, 10)
+	metrics.AddBytes(gw.DirNatsToWS, 5)
+	metrics.AddBytes(gw.DirWSToNats, 3)
+	metrics.IncErrors()
+	metrics.IncTLSConnections()
+	metrics.IncConnectionsByCompression(true)
+	metrics.IncConnectionsByCompression(false)
+	metrics.IncConnectionsByCompression(false)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.connections))
+	assert.Equal(t, 15.0, testutil.ToFloat64(metrics.bytes.WithLabelValues(gw.DirNatsToWS)))
+	assert.Equal(t, 3.0, testutil.ToFloat64(metrics.bytes.WithLabelValues(gw.DirWSToNats)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.errors))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.tls))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.compression.WithLabelValues("true")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.compression.WithLabelValues("false")))
+	// the gauge, the two directions, the errors, the TLS connections and
+	// the two compression states
+	assert.Equal(t, 7, testutil.CollectAndCount(metrics))
+}
+
+func TestServeHTTP(t *testing.T) {
+	metrics := NewMetrics("natsgw")
+	metrics.IncConnections()
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Assert(t, strings.Contains(recorder.Body.String(), "natsgw_connections 1"))
+}
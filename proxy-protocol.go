@@ -0,0 +1,90 @@
+package gw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+)
+
+// proxyV2Signature starts all the PROXY protocol v2 headers
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// requestAddrs returns the websocket client address and the address it
+// connected to. They are nil if unknown, for example for health checks
+func requestAddrs(r *http.Request) (*net.TCPAddr, *net.TCPAddr) {
+	if r == nil {
+		return nil, nil
+	}
+	src := parseTCPAddr(r.RemoteAddr)
+	var dst *net.TCPAddr
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		dst = parseTCPAddr(addr.String())
+	}
+	return src, dst
+}
+
+func parseTCPAddr(addr string) *net.TCPAddr {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+// proxyHeader returns the PROXY protocol header of the given version (1 or
+// 2) for a connection from src to dst. If any of them is unknown, the header
+// tells the connection is not proxied
+func proxyHeader(version int, src, dst *net.TCPAddr) []byte {
+	if version == 2 {
+		return proxyHeaderV2(src, dst)
+	}
+	return proxyHeaderV1(src, dst)
+}
+
+func proxyHeaderV1(src, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family, srcIP, dstIP := "TCP4", src.IP.To4().String(), dst.IP.To4().String()
+	if src.IP.To4() == nil || dst.IP.To4() == nil {
+		// net.IP prints the IPv4-mapped addresses as IPv4 ones
+		family = "TCP6"
+		srcIP = netip.AddrFrom16([16]byte(src.IP.To16())).String()
+		dstIP = netip.AddrFrom16([16]byte(dst.IP.To16())).String()
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+		family, srcIP, dstIP, src.Port, dst.Port))
+}
+
+func proxyHeaderV2(src, dst *net.TCPAddr) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	if src == nil || dst == nil {
+		// LOCAL command, unspecified family
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	family := byte(0x11) // TCP over IPv4
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		family = 0x21 // TCP over IPv6
+	}
+	// PROXY command
+	buf.Write([]byte{0x21, family})
+	binary.Write(&buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+	return buf.Bytes()
+}
@@ -0,0 +1,69 @@
+package gw
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestProxyHeader(t *testing.T) {
+	v4src := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}
+	v4dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	v6src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	for _, tt := range []struct {
+		name     string
+		version  int
+		src, dst *net.TCPAddr
+		expected string
+	}{
+		{"v1 ipv4", 1, v4src, v4dst, "PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n"},
+		{"v1 ipv6", 1, v6src, v4dst, "PROXY TCP6 2001:db8::1 ::ffff:10.0.0.1 56324 443\r\n"},
+		{"v1 unknown", 1, nil, v4dst, "PROXY UNKNOWN\r\n"},
+		{
+			"v2 ipv4", 2, v4src, v4dst,
+			"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c" +
+				"\xc0\xa8\x00\x01\x0a\x00\x00\x01\xdc\x04\x01\xbb",
+		},
+		{
+			"v2 ipv6", 2, v6src, v4dst,
+			"\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x0a\x00\x00\x01" +
+				"\xdc\x04\x01\xbb",
+		},
+		{"v2 unknown", 2, nil, nil, "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, string(proxyHeader(tt.version, tt.src, tt.dst)))
+		})
+	}
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	natsServer, received := newRecordingNatsServer("INFO {}\r\n")
+	server := newTestGateway(t, Settings{SendProxyProtocol: true}, func(conn net.Conn) {
+		buf := make([]byte, 128)
+		n, _ := conn.Read(buf)
+		received <- string(buf[:n])
+		natsServer(conn)
+	})
+	wsConn := dialTestGateway(t, server)
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+
+	src := parseTCPAddr(wsConn.LocalAddr().String())
+	dst := parseTCPAddr(wsConn.RemoteAddr().String())
+	assert.Equal(t, string(proxyHeader(1, src, dst)), <-received)
+}
+
+func TestRequestAddrs(t *testing.T) {
+	src, dst := requestAddrs(nil)
+	assert.Assert(t, src == nil && dst == nil)
+
+	r, _ := http.NewRequest("GET", "/nats", nil)
+	r.RemoteAddr = "[::1]:1234"
+	src, dst = requestAddrs(r)
+	assert.Equal(t, "[::1]:1234", src.String())
+	assert.Assert(t, dst == nil)
+}
@@ -0,0 +1,111 @@
+package gw
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is used in Settings for limiting the rate of incoming
+// connections per client IP
+type RateLimiter interface {
+	// Allow tells if a new connection from ip is allowed
+	Allow(ip string) bool
+}
+
+// tokenBucket is a token bucket refilled at rate tokens per second, up to
+// burst tokens
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take removes n tokens if available
+func (b *tokenBucket) take(now time.Time, n float64) bool {
+	b.refill(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// reserve removes n tokens, possibly going below zero, and returns how long
+// to wait for the tokens to be actually available
+func (b *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// TokenBucketLimiter is a RateLimiter allowing, for each IP, rate connections
+// per second with bursts of up to burst connections
+type TokenBucketLimiter struct {
+	rate  float64
+	burst int
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+// NewTokenBucketLimiter creates a TokenBucketLimiter
+func NewTokenBucketLimiter(rate float64, burst int) *TokenBucketLimiter {
+	return &TokenBucketLimiter{
+		rate:    rate,
+		burst:   burst,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow implements RateLimiter
+func (l *TokenBucketLimiter) Allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.prune(now)
+	bucket, ok := l.buckets[ip]
+	if !ok {
+		bucket = newTokenBucket(l.rate, l.burst, now)
+		l.buckets[ip] = bucket
+	}
+	return bucket.take(now, 1)
+}
+
+// prune forgets the buckets that are full again, so that the map does not
+// grow with every IP ever seen
+func (l *TokenBucketLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for ip, bucket := range l.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
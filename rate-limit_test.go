@@ -0,0 +1,151 @@
+package gw
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gotest.tools/assert"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := NewTokenBucketLimiter(1, 2)
+	limiter.now = func() time.Time { return now }
+
+	assert.Assert(t, limiter.Allow("1.2.3.4"))
+	assert.Assert(t, limiter.Allow("1.2.3.4"))
+	assert.Assert(t, !limiter.Allow("1.2.3.4"))
+	assert.Assert(t, limiter.Allow("5.6.7.8"))
+
+	now = now.Add(time.Second)
+	assert.Assert(t, limiter.Allow("1.2.3.4"))
+	assert.Assert(t, !limiter.Allow("1.2.3.4"))
+
+	now = now.Add(time.Hour)
+	limiter.Allow("1.2.3.4")
+	assert.Equal(t, 1, len(limiter.buckets))
+}
+
+type denyAll struct{}
+
+func (denyAll) Allow(string) bool { return false }
+
+func TestRateLimiterHandler(t *testing.T) {
+	gateway := NewGateway(Settings{NatsAddr: "localhost:4222", RateLimiter: denyAll{}})
+	rec := httptest.NewRecorder()
+	gateway.Handler(rec, httptest.NewRequest("GET", "/nats", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+}
+
+func TestMaxMessagesPerSecond(t *testing.T) {
+	pubs := strings.Repeat("PUB foo 1\r\nx\r\n", 3)
+	t.Run("delay", func(t *testing.T) {
+		natsServer, received := newRecordingNatsServer("INFO {}\r\n")
+		server := newTestGateway(t, Settings{MaxMessagesPerSecond: 20, MessagesBurst: 1}, natsServer)
+		wsConn := dialTestGateway(t, server)
+		assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+
+		start := time.Now()
+		assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte(pubs)))
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, "PUB foo 1\r\n", <-received)
+			assert.Equal(t, "x\r\n", <-received)
+		}
+		elapsed := time.Since(start)
+		assert.Assert(t, elapsed >= 90*time.Millisecond, "elapsed %s", elapsed)
+	})
+	t.Run("drop", func(t *testing.T) {
+		natsServer, received := newRecordingNatsServer("INFO {}\r\n")
+		stats := make(chan *ConnStats, 1)
+		server := newTestGateway(t, Settings{
+			MaxMessagesPerSecond: 1,
+			DropThrottled:        true,
+			OnConnClose:          func(s *ConnStats) { stats <- s },
+		}, natsServer)
+		wsConn := dialTestGateway(t, server)
+		assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+
+		assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte(pubs+"PING\r\n")))
+		assert.Equal(t, "-ERR 'Message Rate Exceeded'\r\n", readWSMessage(t, wsConn))
+		assert.Equal(t, "-ERR 'Message Rate Exceeded'\r\n", readWSMessage(t, wsConn))
+		assert.Equal(t, "PUB foo 1\r\n", <-received)
+		assert.Equal(t, "x\r\n", <-received)
+		assert.Equal(t, "PING\r\n", <-received)
+
+		wsConn.Close()
+		assert.Equal(t, int64(2), (<-stats).ThrottledWSToNats.Load())
+	})
+}
+
+func TestMaxBytesPerSecond(t *testing.T) {
+	payload := strings.Repeat("x", 300)
+	pub := "PUB foo 300\r\n" + payload + "\r\n"
+	for name, info := range map[string]string{
+		"raw":    "INFO {\"headers\":true}\r\n",
+		"framed": "INFO {\"max_payload\":1024}\r\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			natsServer, received := newRecordingNatsServer(info)
+			stats := make(chan *ConnStats, 1)
+			server := newTestGateway(t, Settings{
+				MaxBytesPerSecond: 1000,
+				BytesBurst:        100,
+				OnConnClose:       func(s *ConnStats) { stats <- s },
+			}, natsServer)
+			wsConn := dialTestGateway(t, server)
+			assert.Equal(t, info, readWSMessage(t, wsConn))
+
+			start := time.Now()
+			assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte(pub)))
+			assert.Equal(t, "PUB foo 300\r\n", <-received)
+			assert.Equal(t, payload+"\r\n", <-received)
+			elapsed := time.Since(start)
+			assert.Assert(t, elapsed >= 150*time.Millisecond, "elapsed %s", elapsed)
+
+			wsConn.Close()
+			assert.Equal(t, int64(0), (<-stats).BytesQuota.Load())
+		})
+	}
+}
+
+func TestMaxBytesPerSecondPing(t *testing.T) {
+	// the gateway PONG is not delayed by a paced client message
+	sent := make(chan struct{})
+	received := make(chan string, 10)
+	natsServer := func(conn net.Conn) {
+		conn.Write([]byte("INFO {\"headers\":true}\r\n"))
+		go func() {
+			<-sent
+			time.Sleep(50 * time.Millisecond)
+			conn.Write([]byte("PING\r\n"))
+		}()
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			received <- line
+		}
+	}
+	server := newTestGateway(t, Settings{
+		HandlePing:        true,
+		MaxBytesPerSecond: 1000,
+		BytesBurst:        100,
+	}, natsServer)
+	wsConn := dialTestGateway(t, server)
+	assert.Equal(t, "INFO {\"headers\":true}\r\n", readWSMessage(t, wsConn))
+
+	payload := strings.Repeat("x", 300)
+	assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte("PUB foo 300\r\n"+payload+"\r\n")))
+	close(sent)
+	assert.Equal(t, "PONG\r\n", <-received)
+	assert.Equal(t, "PUB foo 300\r\n", <-received)
+	assert.Equal(t, payload+"\r\n", <-received)
+}
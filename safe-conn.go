@@ -0,0 +1,56 @@
+package gw
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// safeConn wraps a websocket connection so that it can be written from
+// several goroutines: gorilla/websocket supports at most one concurrent
+// writer, and the gateway writes from both workers (forwarded commands,
+// -ERR answers...).
+//
+// The data messages are serialized under a mutex. The control frames go
+// through WriteControl, which gorilla/websocket allows concurrently with the
+// other writes, so that a close or a pong is never stuck behind a blocked
+// data write
+type safeConn struct {
+	*websocket.Conn
+
+	mu           sync.Mutex
+	writeTimeout time.Duration
+	// compressionMinSize is the size of the smallest message to compress,
+	// -1 if compression is disabled
+	compressionMinSize int
+}
+
+func newSafeConn(conn *websocket.Conn, writeTimeout time.Duration) *safeConn {
+	return &safeConn{
+		Conn:               conn,
+		writeTimeout:       writeTimeout,
+		compressionMinSize: -1,
+	}
+}
+
+// WriteMessage writes a data message, applying the write timeout
+func (c *safeConn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	if c.compressionMinSize >= 0 {
+		c.Conn.EnableWriteCompression(len(data) >= c.compressionMinSize)
+	}
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// writeClose sends a close message, without closing the connection
+func (c *safeConn) writeClose(code int, reason string) error {
+	return c.Conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, closeReason(reason)),
+		time.Now().Add(time.Second))
+}
@@ -0,0 +1,81 @@
+package gw
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gotest.tools/assert"
+)
+
+func TestSafeConnConcurrentWrites(t *testing.T) {
+	const writers, messages = 8, 50
+	connCh := make(chan *safeConn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsConn, err := defaultUpgrader.Upgrade(w, r, nil)
+		assert.NilError(t, err)
+		connCh <- newSafeConn(wsConn, 0)
+	}))
+	defer server.Close()
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.NilError(t, err)
+	defer client.Close()
+	conn := <-connCh
+	defer conn.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				conn.WriteMessage(websocket.TextMessage, []byte("PING\r\n"))
+			}
+		}()
+	}
+	for i := 0; i < writers*messages; i++ {
+		assert.Equal(t, "PING\r\n", readWSMessage(t, client))
+	}
+	wg.Wait()
+}
+
+func TestWriteTimeout(t *testing.T) {
+	big := strings.Repeat("x", 16*1024*1024)
+	var mu sync.Mutex
+	var errs []error
+	closed := make(chan struct{})
+	server := newTestGateway(t, Settings{
+		WriteTimeout: 100 * time.Millisecond,
+		ErrorHandler: func(err error) {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		},
+		OnConnClose: func(*ConnStats) { close(closed) },
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+		fmt.Fprintf(conn, "MSG foo 1 %d\r\n%s\r\n", len(big), big)
+		conn.Read(make([]byte, 1))
+	})
+	// the client stops reading after the INFO
+	wsConn := dialTestGateway(t, server)
+	readWSMessage(t, wsConn)
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pair was not torn down")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, len(errs), "%v", errs)
+	var netErr net.Error
+	assert.Assert(t, errors.As(errs[0], &netErr) && netErr.Timeout(), "%v", errs[0])
+}
@@ -0,0 +1,74 @@
+package gw
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ServerInfo is the parsed content of the INFO nats message
+type ServerInfo struct {
+	ServerID     string   `json:"server_id"`
+	ServerName   string   `json:"server_name,omitempty"`
+	Version      string   `json:"version"`
+	GoVersion    string   `json:"go,omitempty"`
+	Host         string   `json:"host,omitempty"`
+	Port         int      `json:"port,omitempty"`
+	MaxPayload   int64    `json:"max_payload"`
+	Proto        int      `json:"proto,omitempty"`
+	Headers      bool     `json:"headers,omitempty"`
+	ClientID     uint64   `json:"client_id,omitempty"`
+	AuthRequired bool     `json:"auth_required,omitempty"`
+	TLSRequired  bool     `json:"tls_required,omitempty"`
+	TLSVerify    bool     `json:"tls_verify,omitempty"`
+	TLSAvailable bool     `json:"tls_available,omitempty"`
+	ConnectURLs  []string `json:"connect_urls,omitempty"`
+	LameDuckMode bool     `json:"ldm,omitempty"`
+	JetStream    bool     `json:"jetstream,omitempty"`
+	Nonce        string   `json:"nonce,omitempty"`
+	ClientIP     string   `json:"client_ip,omitempty"`
+	Cluster      string   `json:"cluster,omitempty"`
+	Domain       string   `json:"domain,omitempty"`
+	XKey         string   `json:"xkey,omitempty"`
+}
+
+// SupportsNoResponders tells if the server can answer the requests without
+// subscribers with a 503 status message, which the clients enable with the
+// no_responders CONNECT option. It requires the headers support
+func (info ServerInfo) SupportsNoResponders() bool {
+	return info.Headers && info.Proto >= 1
+}
+
+// SupportsNKeys tells if the server accepts the nkey and JWT
+// authentications, that is if it sent a nonce for the client to sign
+func (info ServerInfo) SupportsNKeys() bool {
+	return info.Nonce != ""
+}
+
+// Parse parses the raw INFO json
+func (info NatsServerInfo) Parse() (ServerInfo, error) {
+	var parsed ServerInfo
+	if err := json.Unmarshal([]byte(info), &parsed); err != nil {
+		return ServerInfo{}, fmt.Errorf("%w json: %w", ErrInvalidInfo, err)
+	}
+	return parsed, nil
+}
+
+// sanitizedInfo holds the INFO fields forwarded to the clients with
+// Settings.SanitizeInfo
+type sanitizedInfo struct {
+	MaxPayload int64  `json:"max_payload"`
+	Proto      int    `json:"proto"`
+	Headers    bool   `json:"headers,omitempty"`
+	Nonce      string `json:"nonce,omitempty"`
+}
+
+// sanitized returns the INFO json keeping only the fields the clients need
+func (info ServerInfo) sanitized() NatsServerInfo {
+	data, _ := json.Marshal(sanitizedInfo{
+		MaxPayload: info.MaxPayload,
+		Proto:      info.Proto,
+		Headers:    info.Headers,
+		Nonce:      info.Nonce,
+	})
+	return NatsServerInfo(data)
+}
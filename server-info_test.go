@@ -0,0 +1,60 @@
+package gw
+
+import (
+	"net"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestServerInfoParse(t *testing.T) {
+	info, err := NatsServerInfo(`{"server_id":"abc","version":"2.10.0","proto":1,` +
+		`"max_payload":1048576,"auth_required":true,"tls_required":true,` +
+		`"connect_urls":["10.0.0.1:4222","10.0.0.2:4222"]}`).Parse()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, ServerInfo{
+		ServerID:     "abc",
+		Version:      "2.10.0",
+		Proto:        1,
+		MaxPayload:   1048576,
+		AuthRequired: true,
+		TLSRequired:  true,
+		ConnectURLs:  []string{"10.0.0.1:4222", "10.0.0.2:4222"},
+	}, info)
+
+	assert.Assert(t, !info.SupportsNoResponders())
+	assert.Assert(t, !info.SupportsNKeys())
+
+	info, err = NatsServerInfo(`{"server_id":"abc","proto":1,"headers":true,` +
+		`"jetstream":true,"nonce":"n0nce","client_ip":"10.0.0.3","cluster":"c1",` +
+		`"domain":"hub","xkey":"XKEY"}`).Parse()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, ServerInfo{
+		ServerID:  "abc",
+		Proto:     1,
+		Headers:   true,
+		JetStream: true,
+		Nonce:     "n0nce",
+		ClientIP:  "10.0.0.3",
+		Cluster:   "c1",
+		Domain:    "hub",
+		XKey:      "XKEY",
+	}, info)
+	assert.Assert(t, info.SupportsNoResponders())
+	assert.Assert(t, info.SupportsNKeys())
+
+	_, err = NatsServerInfo(`{"server_id":`).Parse()
+	assert.ErrorContains(t, err, "Invalid 'INFO' json")
+}
+
+func TestSanitizeInfo(t *testing.T) {
+	server := newTestGateway(t, Settings{SanitizeInfo: true}, func(conn net.Conn) {
+		conn.Write([]byte(`INFO {"server_id":"abc","version":"2.10.0","proto":1,` +
+			`"headers":true,"max_payload":1048576,"host":"10.0.0.1","port":4222,"nonce":"n0nce",` +
+			`"connect_urls":["10.0.0.1:4222","10.0.0.2:4222"]}` + "\r\n"))
+		conn.Read(make([]byte, 1))
+	})
+	wsConn := dialTestGateway(t, server)
+	assert.Equal(t, "INFO {\"max_payload\":1048576,\"proto\":1,\"headers\":true,\"nonce\":\"n0nce\"}\r\n",
+		readWSMessage(t, wsConn))
+}
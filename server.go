@@ -0,0 +1,114 @@
+package gw
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// The timeouts of the servers built by Gateway.Server. They only apply up to
+// the websocket upgrade, gorilla/websocket clearing the deadlines of the
+// upgraded connections
+const (
+	serverReadHeaderTimeout = 10 * time.Second
+	serverReadTimeout       = 30 * time.Second
+	serverWriteTimeout      = 30 * time.Second
+	serverIdleTimeout       = 2 * time.Minute
+)
+
+// healthzTimeout bounds the NATS probe of the ServeMux /healthz endpoint
+const healthzTimeout = 5 * time.Second
+
+// Server returns a http.Server listening on addr and serving the gateway on
+// all the paths. For more complex setups, see Handler
+func (gw *Gateway) Server(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           http.HandlerFunc(gw.Handler),
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
+		TLSConfig:         gw.settings.ListenTLSConfig,
+	}
+}
+
+// ServeMux returns a mux serving the gateway at path, along with the usual
+// operational endpoints:
+//
+//   - /healthz answers 200 if the NATS server can be connected, see Healthy,
+//     and 503 otherwise
+//   - /metrics serves the Settings.Metrics, if they are a http.Handler like
+//     the ones of the prometheus package
+//
+// Use Handler to mount the gateway in another router
+func (gw *Gateway) ServeMux(path string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, gw.Handler)
+	mux.HandleFunc("/healthz", gw.healthz)
+	if handler, ok := gw.metrics.(http.Handler); ok {
+		mux.Handle("/metrics", handler)
+	}
+	return mux
+}
+
+// healthz is the ServeMux /healthz endpoint
+func (gw *Gateway) healthz(w http.ResponseWriter, r *http.Request) {
+	if gw.isShuttingDown() {
+		http.Error(w, "gateway is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), healthzTimeout)
+	defer cancel()
+	if err := gw.Healthy(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// ListenAndServe serves the gateway on addr, until Shutdown is called in
+// which case http.ErrServerClosed is returned
+func (gw *Gateway) ListenAndServe(addr string) error {
+	server, err := gw.startServer(addr)
+	if err != nil {
+		return err
+	}
+	return server.ListenAndServe()
+}
+
+// ListenAndServeTLS is ListenAndServe with TLS, configured by
+// Settings.ListenTLSConfig if set. The certificate files may be empty if the
+// configuration already has the certificates, see
+// http.Server.ListenAndServeTLS
+func (gw *Gateway) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	server, err := gw.startServer(addr)
+	if err != nil {
+		return err
+	}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// startServer builds a server, shut down along with the gateway
+func (gw *Gateway) startServer(addr string) (*http.Server, error) {
+	server := gw.Server(addr)
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	if gw.shuttingDown {
+		return nil, http.ErrServerClosed
+	}
+	gw.servers = append(gw.servers, server)
+	return server, nil
+}
+
+// shutdownServers stops the servers started by ListenAndServe from accepting
+// new connections
+func (gw *Gateway) shutdownServers(ctx context.Context) {
+	gw.mu.Lock()
+	servers := gw.servers
+	gw.servers = nil
+	gw.mu.Unlock()
+	for _, server := range servers {
+		server.Shutdown(ctx)
+	}
+}
@@ -0,0 +1,102 @@
+package gw
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gotest.tools/assert"
+)
+
+func TestServer(t *testing.T) {
+	listenTLS := &tls.Config{MinVersion: tls.VersionTLS13}
+	gateway := NewGateway(Settings{
+		NatsAddr:        "localhost:4222",
+		EnableTLS:       true,
+		NatsTLSConfig:   &tls.Config{ServerName: "nats"},
+		ListenTLSConfig: listenTLS,
+	})
+	server := gateway.Server(":8910")
+	assert.Equal(t, ":8910", server.Addr)
+	assert.Equal(t, listenTLS, server.TLSConfig)
+	assert.Assert(t, server.ReadHeaderTimeout > 0)
+	assert.Assert(t, server.IdleTimeout > 0)
+}
+
+func TestListenAndServe(t *testing.T) {
+	gateway := NewGateway(Settings{NatsAddr: "localhost:4222"})
+	served := make(chan error, 1)
+	go func() {
+		served <- gateway.ListenAndServe("127.0.0.1:0")
+	}()
+	// wait for the server to be registered
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		gateway.mu.Lock()
+		started := len(gateway.servers) != 0
+		gateway.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.NilError(t, gateway.Shutdown(context.Background()))
+	assert.Equal(t, http.ErrServerClosed, <-served)
+	// a gateway shut down does not serve anymore
+	assert.Equal(t, http.ErrServerClosed, gateway.ListenAndServe("127.0.0.1:0"))
+}
+
+type handlerMetrics struct {
+	NoopMetrics
+}
+
+func (handlerMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("metrics"))
+}
+
+func TestServeMux(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		info    string
+		metrics Metrics
+		healthz int
+		metricz int
+	}{
+		{"healthy", "INFO {}\r\n", handlerMetrics{}, http.StatusOK, http.StatusOK},
+		{"unhealthy", "PING\r\n", nil, http.StatusServiceUnavailable, http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway, _ := startTestGateway(t, Settings{Metrics: tt.metrics}, func(conn net.Conn) {
+				conn.Write([]byte(tt.info))
+				conn.Read(make([]byte, 1))
+			})
+			server := httptest.NewServer(gateway.ServeMux("/nats"))
+			defer server.Close()
+
+			resp, err := http.Get(server.URL + "/healthz")
+			assert.NilError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.healthz, resp.StatusCode)
+
+			resp, err = http.Get(server.URL + "/metrics")
+			assert.NilError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.metricz, resp.StatusCode)
+
+			if tt.healthz == http.StatusOK {
+				wsConn, _, err := websocket.DefaultDialer.Dial(
+					"ws"+strings.TrimPrefix(server.URL, "http")+"/nats", nil)
+				assert.NilError(t, err)
+				assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+				wsConn.Close()
+			}
+		})
+	}
+}
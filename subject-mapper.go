@@ -0,0 +1,68 @@
+package gw
+
+import (
+	"bytes"
+	"strings"
+)
+
+// SubjectMapper maps the subjects between the websocket clients and the NATS
+// server, for example to isolate the tenants sharing a NATS server
+type SubjectMapper interface {
+	// MapOutgoing maps a subject sent by a client to the NATS subject
+	MapOutgoing(subject string) string
+	// MapIncoming maps a NATS subject back to the client subject
+	MapIncoming(subject string) string
+}
+
+// PrefixSubjectMapper is a SubjectMapper prepending a prefix, for example
+// "tenant123.", to the client subjects
+type PrefixSubjectMapper string
+
+// MapOutgoing prepends the prefix
+func (p PrefixSubjectMapper) MapOutgoing(subject string) string {
+	return string(p) + subject
+}
+
+// MapIncoming strips the prefix
+func (p PrefixSubjectMapper) MapIncoming(subject string) string {
+	return strings.TrimPrefix(subject, string(p))
+}
+
+// subjectArgs returns the positions, among the arguments of a command, of
+// the subjects to map: the subject and, if any, the reply subject
+func subjectArgs(op string, args [][]byte) []int {
+	if len(args) == 0 {
+		return nil
+	}
+	switch {
+	case op == "SUB":
+		return []int{0}
+	case op == "PUB" && len(args) == 3, op == "HPUB" && len(args) == 4:
+		return []int{0, 1}
+	case op == "MSG" && len(args) == 4, op == "HMSG" && len(args) == 5:
+		return []int{0, 2}
+	case op == "PUB", op == "HPUB", op == "MSG", op == "HMSG":
+		return []int{0}
+	}
+	return nil
+}
+
+// mapSubjects rewrites the subjects of a PUB, HPUB, SUB, MSG or HMSG command
+// with mapSubject. The other commands are returned as is
+func mapSubjects(cmd []byte, mapSubject func(string) string) []byte {
+	end := bytes.Index(cmd, []byte("\r\n"))
+	if end < 0 {
+		return cmd
+	}
+	op, args := splitCommand(cmd[:end])
+	positions := subjectArgs(op, args)
+	if len(positions) == 0 {
+		return cmd
+	}
+	for _, i := range positions {
+		args[i] = []byte(mapSubject(string(args[i])))
+	}
+	mapped := append([]byte(op), ' ')
+	mapped = append(mapped, bytes.Join(args, []byte(" "))...)
+	return append(mapped, cmd[end:]...)
+}
@@ -0,0 +1,51 @@
+package gw
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"gotest.tools/assert"
+)
+
+func TestMapSubjects(t *testing.T) {
+	mapper := PrefixSubjectMapper("tenant.")
+	for _, tt := range []struct {
+		cmd      string
+		expected string
+	}{
+		{"PUB foo 2\r\nhi\r\n", "PUB tenant.foo 2\r\nhi\r\n"},
+		{"PUB foo inbox 2\r\nhi\r\n", "PUB tenant.foo tenant.inbox 2\r\nhi\r\n"},
+		{"HPUB foo inbox 12 14\r\nNATS/1.0\r\n\r\nhi\r\n", "HPUB tenant.foo tenant.inbox 12 14\r\nNATS/1.0\r\n\r\nhi\r\n"},
+		{"SUB foo 1\r\n", "SUB tenant.foo 1\r\n"},
+		{"SUB foo workers 1\r\n", "SUB tenant.foo workers 1\r\n"},
+		{"UNSUB 1\r\n", "UNSUB 1\r\n"},
+		{"SUB\r\n", "SUB\r\n"},
+		{"PING\r\n", "PING\r\n"},
+	} {
+		assert.Equal(t, tt.expected, string(mapSubjects([]byte(tt.cmd), mapper.MapOutgoing)))
+	}
+	for _, tt := range []struct {
+		cmd      string
+		expected string
+	}{
+		{"MSG tenant.foo 1 2\r\nhi\r\n", "MSG foo 1 2\r\nhi\r\n"},
+		{"MSG tenant.foo 1 tenant.inbox 2\r\nhi\r\n", "MSG foo 1 inbox 2\r\nhi\r\n"},
+		{"HMSG tenant.foo 1 12 14\r\nNATS/1.0\r\n\r\nhi\r\n", "HMSG foo 1 12 14\r\nNATS/1.0\r\n\r\nhi\r\n"},
+		{"HMSG tenant.foo 1 tenant.inbox 12 14\r\nNATS/1.0\r\n\r\nhi\r\n", "HMSG foo 1 inbox 12 14\r\nNATS/1.0\r\n\r\nhi\r\n"},
+		{"+OK\r\n", "+OK\r\n"},
+	} {
+		assert.Equal(t, tt.expected, string(mapSubjects([]byte(tt.cmd), mapper.MapIncoming)))
+	}
+}
+
+func TestSubjectMapper(t *testing.T) {
+	natsServer, received := newRecordingNatsServer(
+		"INFO {}\r\nMSG tenant.foo 1 tenant.inbox 2\r\nhi\r\n")
+	server := newTestGateway(t, Settings{SubjectMapper: PrefixSubjectMapper("tenant.")}, natsServer)
+	wsConn := dialTestGateway(t, server)
+	assert.Equal(t, "INFO {}\r\n", readWSMessage(t, wsConn))
+	assert.Equal(t, "MSG foo 1 inbox 2\r\nhi\r\n", readWSMessage(t, wsConn))
+
+	assert.NilError(t, wsConn.WriteMessage(websocket.TextMessage, []byte("SUB foo 1\r\n")))
+	assert.Equal(t, "SUB tenant.foo 1\r\n", <-received)
+}
@@ -0,0 +1,309 @@
+package gw
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gotest.tools/assert"
+)
+
+// newTestCertificate creates a self-signed certificate for host
+func newTestCertificate(t *testing.T, host string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.NilError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NilError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+// tlsNatsServer returns a fake NATS server requiring TLS. It reports the
+// handshake result on the returned channel
+func tlsNatsServer(config *tls.Config) (func(net.Conn), chan *tls.Conn) {
+	handshakes := make(chan *tls.Conn, 1)
+	return func(conn net.Conn) {
+		conn.Write([]byte("INFO {\"tls_required\":true}\r\n"))
+		tlsConn := tls.Server(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			handshakes <- nil
+			return
+		}
+		handshakes <- tlsConn
+		tlsConn.Read(make([]byte, 1))
+	}, handshakes
+}
+
+func TestTLSRequired(t *testing.T) {
+	cert, pool := newTestCertificate(t, "nats")
+	for _, name := range []string{"NatsTLSConfig", "TLSConfig"} {
+		t.Run(name, func(t *testing.T) {
+			natsServer, handshakes := tlsNatsServer(&tls.Config{Certificates: []tls.Certificate{cert}})
+			natsConns := make(chan *NatsConn, 1)
+			connected := make(chan [2]string, 1)
+			metrics := &fakeMetrics{bytes: make(map[string]int64)}
+			settings := Settings{
+				EnableTLS: true,
+				Metrics:   metrics,
+				ConnectHandler: func(natsConn *NatsConn, r *http.Request, wsConn *websocket.Conn) error {
+					natsConns <- natsConn
+					return natsConn.forwardInfo(wsConn)
+				},
+				OnConnect: func(r *http.Request, natsConn *NatsConn) {
+					connected <- [2]string{natsConn.TLSVersion(), natsConn.TLSCipherSuite()}
+				},
+			}
+			tlsConfig := &tls.Config{RootCAs: pool, ServerName: "nats"}
+			if name == "TLSConfig" {
+				settings.TLSConfig = tlsConfig
+			} else {
+				settings.NatsTLSConfig = tlsConfig
+			}
+			server := newTestGateway(t, settings, natsServer)
+			wsConn := dialTestGateway(t, server)
+
+			assert.Equal(t, "INFO {\"tls_required\":true}\r\n", readWSMessage(t, wsConn))
+			assert.Assert(t, <-handshakes != nil)
+			natsConn := <-natsConns
+			assert.Assert(t, natsConn.TLSState != nil)
+			assert.Assert(t, natsConn.TLSState.HandshakeComplete)
+			assert.Assert(t, natsConn.RemoteAddr != nil)
+			negotiated := <-connected
+			assert.Equal(t, tls.VersionName(natsConn.TLSState.Version), negotiated[0])
+			assert.Assert(t, negotiated[0] != "" && negotiated[1] != "")
+			assert.Equal(t, 1, metrics.snapshot().tls)
+		})
+	}
+}
+
+// writeTestCertificate writes a certificate and its key as PEM files, and
+// returns their paths
+func writeTestCertificate(t *testing.T, cert tls.Certificate) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	assert.NilError(t, err)
+	assert.NilError(t, os.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+	assert.NilError(t, os.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600))
+	return certFile, keyFile
+}
+
+func TestNatsClientCert(t *testing.T) {
+	serverCert, serverPool := newTestCertificate(t, "nats")
+	clientCert, clientPool := newTestCertificate(t, "gateway")
+	certFile, keyFile := writeTestCertificate(t, clientCert)
+
+	natsServer, handshakes := tlsNatsServer(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientPool,
+	})
+	natsConns := make(chan *NatsConn, 1)
+	server := newTestGateway(t, Settings{
+		EnableTLS:      true,
+		NatsTLSConfig:  &tls.Config{RootCAs: serverPool, ServerName: "nats"},
+		NatsClientCert: certFile,
+		NatsClientKey:  keyFile,
+		OnConnect:      func(r *http.Request, natsConn *NatsConn) { natsConns <- natsConn },
+	}, natsServer)
+	wsConn := dialTestGateway(t, server)
+	readWSMessage(t, wsConn)
+
+	tlsConn := <-handshakes
+	assert.Assert(t, tlsConn != nil)
+	assert.Equal(t, "gateway", tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	natsConn := <-natsConns
+	assert.Equal(t, 1, len(natsConn.TLSState.VerifiedChains))
+
+	_, err := NewGatewayWithValidation(Settings{
+		NatsAddr:       "nats:4222",
+		EnableTLS:      true,
+		NatsClientCert: certFile,
+		NatsClientKey:  filepath.Join(t.TempDir(), "missing.pem"),
+	})
+	assert.Assert(t, err != nil && strings.HasPrefix(err.Error(), "Invalid settings: NatsClientCert: "), "%v", err)
+}
+
+func TestNatsTLSVerification(t *testing.T) {
+	cert, _ := newTestCertificate(t, "nats")
+	for _, insecure := range []bool{false, true} {
+		t.Run(fmt.Sprintf("insecure=%v", insecure), func(t *testing.T) {
+			natsServer, handshakes := tlsNatsServer(&tls.Config{Certificates: []tls.Certificate{cert}})
+			errs := make(chan error, 1)
+			server := newTestGateway(t, Settings{
+				EnableTLS:       true,
+				NatsTLSInsecure: insecure,
+				ErrorHandler:    func(err error) { errs <- err },
+				// net.Pipe is unbuffered: the alert sent on the rejection
+				// of the certificate blocks until the deadline
+				DialTimeout: 200 * time.Millisecond,
+			}, natsServer)
+			wsConn := dialTestGateway(t, server)
+
+			if insecure {
+				readWSMessage(t, wsConn)
+				assert.Assert(t, <-handshakes != nil)
+				return
+			}
+			// the self-signed certificate is rejected
+			assert.Assert(t, <-handshakes == nil)
+			err := <-errs
+			var verifyErr *tls.CertificateVerificationError
+			assert.Assert(t, errors.Is(err, ErrTLSHandshake), "%v", err)
+			assert.Assert(t, errors.As(err, &verifyErr), "%v", err)
+		})
+	}
+}
+
+func TestTLSHandshakeError(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		server  func(net.Conn)
+		timeout bool
+	}{
+		{"garbage", func(conn net.Conn) {
+			conn.Write([]byte("INFO {\"tls_required\":true}\r\n"))
+			conn.Read(make([]byte, 64*1024))
+			conn.Write([]byte("not a TLS record\r\n"))
+			conn.Read(make([]byte, 1))
+		}, false},
+		{"stalled", func(conn net.Conn) {
+			conn.Write([]byte("INFO {\"tls_required\":true}\r\n"))
+			// the handshake is never answered
+			io.Copy(io.Discard, conn)
+		}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := make(chan error, 1)
+			server := newTestGateway(t, Settings{
+				NatsTLSInsecure: true,
+				DialTimeout:     100 * time.Millisecond,
+				ErrorHandler:    func(err error) { errs <- err },
+			}, tt.server)
+			start := time.Now()
+			dialTestGateway(t, server)
+
+			err := <-errs
+			assert.Assert(t, errors.Is(err, ErrTLSHandshake), "%v", err)
+			var netErr net.Error
+			assert.Equal(t, tt.timeout, errors.As(err, &netErr) && netErr.Timeout(), "%v", err)
+			assert.Assert(t, time.Since(start) < time.Second)
+		})
+	}
+}
+
+func TestTLSNotAvailable(t *testing.T) {
+	errs := make(chan error, 1)
+	server := newTestGateway(t, Settings{
+		EnableTLS:       true,
+		NatsTLSInsecure: true,
+		ErrorHandler:    func(err error) { errs <- err },
+	}, func(conn net.Conn) {
+		conn.Write([]byte("INFO {}\r\n"))
+		conn.Read(make([]byte, 1))
+	})
+	dialTestGateway(t, server)
+
+	err := <-errs
+	assert.Assert(t, err != nil && strings.HasSuffix(err.Error(),
+		"TLS is enabled but not supported by the NATS server"), "%v", err)
+}
+
+func TestNatsTLSServerName(t *testing.T) {
+	cert, pool := newTestCertificate(t, "nats")
+	natsServer, handshakes := tlsNatsServer(&tls.Config{Certificates: []tls.Certificate{cert}})
+	// the certificate is verified against the host of NatsAddr
+	server := newTestGateway(t, Settings{
+		EnableTLS:     true,
+		NatsTLSConfig: &tls.Config{RootCAs: pool},
+	}, natsServer)
+	wsConn := dialTestGateway(t, server)
+	readWSMessage(t, wsConn)
+	tlsConn := <-handshakes
+	assert.Assert(t, tlsConn != nil)
+	assert.Equal(t, "nats", tlsConn.ConnectionState().ServerName)
+
+	for _, tt := range []struct {
+		addr       string
+		serverName string
+		expected   string
+	}{
+		{"nats.example.com:4222", "", "nats.example.com"},
+		{"10.0.0.1:4222", "", ""},
+		{"[::1]:4222", "", ""},
+		{"/var/run/nats.sock", "", ""},
+		{"nats.example.com:4222", "other", "other"},
+	} {
+		config := &tls.Config{ServerName: tt.serverName}
+		assert.Equal(t, tt.expected, natsTLSConfigFor(config, tt.addr).ServerName, tt.addr)
+		// the configuration of the settings is left untouched
+		assert.Equal(t, tt.serverName, config.ServerName)
+	}
+}
+
+func TestNatsTLSUnixSocket(t *testing.T) {
+	// a server requiring TLS on a unix socket cannot be verified without a
+	// ServerName
+	sock := filepath.Join(t.TempDir(), "nats.sock")
+	listener, err := net.Listen("unix", sock)
+	assert.NilError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("INFO {\"tls_required\":true}\r\n"))
+		conn.Read(make([]byte, 1))
+	}()
+
+	errs := make(chan error, 1)
+	gateway := NewGateway(Settings{
+		NatsAddr:     sock,
+		NatsNetwork:  "unix",
+		ErrorHandler: func(err error) { errs <- err },
+	})
+	server := httptest.NewServer(http.HandlerFunc(gateway.Handler))
+	defer server.Close()
+	dialTestGateway(t, server)
+
+	err = <-errs
+	assert.Assert(t, errors.Is(err, ErrTLSHandshake), "%v", err)
+	assert.Assert(t, strings.Contains(err.Error(), "NatsTLSConfig.ServerName is needed"), "%v", err)
+}